@@ -1,15 +1,22 @@
 package gj
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"log"
 
 	"github.com/gin-gonic/gin"
+	"github.com/yoru9zine/gj/pkg/cgroup"
 	"github.com/yoru9zine/gj/pkg/id"
+	"github.com/yoru9zine/gj/pkg/store"
 )
 
 var (
@@ -17,20 +24,64 @@ var (
 	respNotFound      = APIResponseModel{Msg: "not found"}
 	respDuplicated    = APIResponseModel{Msg: "duplicated"}
 	respInternalError = APIResponseModel{Msg: "internal error"}
+	respNotRunning    = APIResponseModel{Msg: "not running"}
+	respStarted       = APIResponseModel{Msg: "already started"}
+	respNotPTY        = APIResponseModel{Msg: "not a pty process"}
+	respActive        = APIResponseModel{Msg: "process is active"}
 	respOK            = APIResponseModel{Msg: "ok"}
 )
 
 type APIServer struct {
 	*gin.Engine
-	Procs Processes
+	Procs     *Registry
+	Schedules *Scheduler
+	Pool      *Pool
+}
+
+// ServerOption configures APIServer
+type ServerOption struct {
+	// DataDir is the directory to keep processes and their logs
+	DataDir string
+	// MaxConcurrency limits runs executing at once. 0 is unlimited.
+	MaxConcurrency int
+	Queues         []*Queue
+	// Cgroup is a writable cgroup v2 directory for cgroups of runs. Empty
+	// disables cgroups, and the server never changes its own cgroup then.
+	Cgroup string
+	// AllowUsers and AllowGroups are names or IDs which processes may run
+	// as. A process with a user needs it here even if it is the server's.
+	AllowUsers  []string
+	AllowGroups []string
+	// IndexLogs saves search indexes of logs of finished runs
+	IndexLogs bool
 }
 
 func (a *APIServer) Setup() {
 	a.GET("/api/v1/procs", a.ShowProcs)
 	a.POST("/api/v1/procs", a.CreateProc)
+	a.DELETE("/api/v1/procs", a.PruneProcs)
 	a.GET("/api/v1/procs/:pid", a.ShowProc)
+	a.DELETE("/api/v1/procs/:pid", a.DeleteProc)
 	a.GET("/api/v1/procs/:pid/start", a.StartProc)
 	a.GET("/api/v1/procs/:pid/log", a.ShowProcLog)
+	a.POST("/api/v1/procs/:pid/stop", a.StopProc)
+	a.POST("/api/v1/procs/:pid/signal", a.SignalProc)
+	a.GET("/api/v1/procs/:pid/attach", a.AttachProc)
+	a.POST("/api/v1/procs/:pid/resize", a.ResizeProc)
+	a.POST("/api/v1/procs/:pid/stdin", a.WriteProcStdin)
+	a.POST("/api/v1/procs/:pid/restart", a.RestartProc)
+	a.GET("/api/v1/procs/:pid/runs", a.ShowRuns)
+	a.GET("/api/v1/procs/:pid/runs/:n", a.ShowRun)
+	a.GET("/api/v1/procs/:pid/runs/:n/log", a.ShowProcLog)
+	a.GET("/api/v1/procs/:pid/stats", a.ShowProcStats)
+	a.GET("/api/v1/logs/search", a.SearchLogs)
+	a.GET("/api/v1/queues", a.ShowQueues)
+	a.GET("/api/v1/schedules", a.ShowSchedules)
+	a.POST("/api/v1/schedules", a.CreateSchedule)
+	a.GET("/api/v1/schedules/:sid", a.ShowSchedule)
+	a.DELETE("/api/v1/schedules/:sid", a.DeleteSchedule)
+	a.POST("/api/v1/schedules/:sid/pause", a.PauseSchedule)
+	a.POST("/api/v1/schedules/:sid/resume", a.ResumeSchedule)
 }
 
 func (a *APIServer) ShowProcs(c *gin.Context) {
@@ -51,9 +102,30 @@ func (a *APIServer) CreateProc(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, respBadRequest)
 		return
 	}
+	if err := pvm.Validate(); err != nil {
+		log.Printf("invalid process: %s", err)
+		c.JSON(http.StatusBadRequest, respBadRequest)
+		return
+	}
+	if !a.Pool.HasQueue(pvm.Queue) {
+		c.JSON(http.StatusBadRequest, APIResponseModel{Msg: fmt.Sprintf("queue %s not found", pvm.Queue)})
+		return
+	}
+	if err := a.Procs.CheckLimits(&pvm.Limits); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponseModel{Msg: err.Error()})
+		return
+	}
+	if err := a.Procs.Allowed(pvm.User, pvm.Group); err != nil {
+		c.JSON(http.StatusForbidden, APIResponseModel{Msg: err.Error()})
+		return
+	}
 	id := id.New()
 	pvm.ID = id
-	a.Procs[pvm.ID] = pvm.Process()
+	if err := a.Procs.Add(pvm.Process()); err != nil {
+		log.Printf("failed to add process: %s", err)
+		c.IndentedJSON(http.StatusInternalServerError, respInternalError)
+		return
+	}
 	c.IndentedJSON(http.StatusOK, APIResponseCreateProc{respOK, id})
 	return
 }
@@ -69,6 +141,49 @@ func (a *APIServer) ShowProc(c *gin.Context) {
 	return
 }
 
+func (a *APIServer) DeleteProc(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	force, _ := strconv.ParseBool(c.Query("force"))
+	if err := a.Procs.Remove(proc, force); err != nil {
+		if err == ErrActive {
+			c.IndentedJSON(http.StatusConflict, respActive)
+			return
+		}
+		log.Printf("failed to remove process %s: %s", proc.ID, err)
+		c.IndentedJSON(http.StatusInternalServerError, respInternalError)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, respOK)
+}
+
+func (a *APIServer) PruneProcs(c *gin.Context) {
+	var olderThan time.Duration
+	if s := c.Query("older_than"); s != "" {
+		d, err := ParseAge(s)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, APIResponseModel{Msg: err.Error()})
+			return
+		}
+		olderThan = d
+	}
+	states := []State{}
+	for _, s := range strings.Split(c.DefaultQuery("state", "finished"), ",") {
+		states = append(states, State(s))
+	}
+	removed, err := a.Procs.Prune(olderThan, states)
+	if err != nil {
+		log.Printf("failed to prune processes: %s", err)
+		c.IndentedJSON(http.StatusInternalServerError, APIResponsePruneProcs{respInternalError, removed})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponsePruneProcs{respOK, removed})
+}
+
 func (a *APIServer) StartProc(c *gin.Context) {
 	pid := c.Param("pid")
 	proc, apierr := a.findProcess(pid)
@@ -77,13 +192,195 @@ func (a *APIServer) StartProc(c *gin.Context) {
 		return
 	}
 	err := proc.Start()
+	if err == ErrAlreadyStarted {
+		c.IndentedJSON(http.StatusConflict, respStarted)
+		return
+	}
 	if err != nil {
 		log.Printf("error at starting process: %s", err)
 		c.String(http.StatusInternalServerError, "ng")
+		return
 	}
 	c.String(http.StatusOK, "ok")
 }
 
+func (a *APIServer) StopProc(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	grace := proc.killGrace()
+	if g := c.Query("grace"); g != "" {
+		d, err := time.ParseDuration(g)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, respBadRequest)
+			return
+		}
+		grace = d
+	}
+	if err := proc.Stop(grace); err != nil {
+		a.respondControlError(c, proc, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, respOK)
+}
+
+func (a *APIServer) SignalProc(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	var req APIRequestSignalProc
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	sig, err := ParseSignal(req.Signal)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, APIResponseModel{Msg: err.Error()})
+		return
+	}
+	if err := proc.Signal(sig); err != nil {
+		a.respondControlError(c, proc, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, respOK)
+}
+
+func (a *APIServer) ResizeProc(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	var size WindowSize
+	if err := c.BindJSON(&size); err != nil {
+		return
+	}
+	if size.Rows == 0 || size.Cols == 0 {
+		c.IndentedJSON(http.StatusBadRequest, respBadRequest)
+		return
+	}
+	if err := proc.Resize(size.Rows, size.Cols); err != nil {
+		a.respondControlError(c, proc, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, respOK)
+}
+
+func (a *APIServer) WriteProcStdin(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	closeStdin, _ := strconv.ParseBool(c.Query("close"))
+	if err := proc.WriteStdin(c.Request.Body, closeStdin); err != nil {
+		a.respondControlError(c, proc, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, respOK)
+}
+
+func (a *APIServer) respondControlError(c *gin.Context, proc *Process, err error) {
+	switch err {
+	case ErrNotRunning:
+		c.IndentedJSON(http.StatusConflict, respNotRunning)
+		return
+	case ErrNotPTY:
+		c.IndentedJSON(http.StatusConflict, respNotPTY)
+		return
+	}
+	log.Printf("failed to control process %s: %s", proc.ID, err)
+	c.IndentedJSON(http.StatusInternalServerError, respInternalError)
+}
+
+func (a *APIServer) RestartProc(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	grace := proc.killGrace()
+	if g := c.Query("grace"); g != "" {
+		d, err := time.ParseDuration(g)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, respBadRequest)
+			return
+		}
+		grace = d
+	}
+	n, err := proc.Restart(grace)
+	if err != nil {
+		if err == ErrActive {
+			c.IndentedJSON(http.StatusConflict, respActive)
+			return
+		}
+		log.Printf("failed to restart process %s: %s", proc.ID, err)
+		c.IndentedJSON(http.StatusInternalServerError, respInternalError)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponseRestartProc{respOK, n})
+}
+
+func (a *APIServer) ShowRuns(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponseShowRuns{respOK, proc.RunViewModels()})
+}
+
+func (a *APIServer) ShowRun(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, respBadRequest)
+		return
+	}
+	run, err := proc.RunViewModel(n)
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, respNotFound)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponseShowRun{respOK, run})
+}
+
+// ShowProcStats shows resource usage of the latest run, or the run given by ?run=n
+func (a *APIServer) ShowProcStats(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	n, err := strconv.Atoi(c.DefaultQuery("run", "0"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, respBadRequest)
+		return
+	}
+	stats, err := proc.Stats(n)
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, respNotFound)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponseShowStats{respOK, stats})
+}
+
+// ShowProcLog shows the log of the latest run, or the run given as :n
 func (a *APIServer) ShowProcLog(c *gin.Context) {
 	pid := c.Param("pid")
 	proc, apierr := a.findProcess(pid)
@@ -91,7 +388,151 @@ func (a *APIServer) ShowProcLog(c *gin.Context) {
 		c.IndentedJSON(apierr.Status, apierr.Model)
 		return
 	}
-	c.String(http.StatusOK, proc.output.String())
+	var n int
+	if s := c.Param("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, respBadRequest)
+			return
+		}
+	}
+	if _, err := proc.findRun(n); err != nil {
+		c.IndentedJSON(http.StatusNotFound, respNotFound)
+		return
+	}
+	opt, err := ParseLogOption(c.Request.URL.Query(), time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, APIResponseModel{Msg: err.Error()})
+		return
+	}
+	if follow, _ := strconv.ParseBool(c.Query("follow")); follow {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := &flushWriter{c.Writer}
+		if err := proc.FollowLog(w, n, c.Request.Context().Done(), opt); err != nil {
+			log.Printf("failed to follow log of %s: %s", proc.ID, err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if err := proc.WriteLog(&buf, n, opt); err != nil {
+		log.Printf("failed to read log of %s: %s", proc.ID, err)
+		c.IndentedJSON(http.StatusInternalServerError, respInternalError)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", buf.Bytes())
+}
+
+// SearchLogs searches logs of all processes, or the process given as proc
+func (a *APIServer) SearchLogs(c *gin.Context) {
+	opt, err := ParseSearchOption(c.Request.URL.Query(), time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, APIResponseModel{Msg: err.Error()})
+		return
+	}
+	if opt.Process != "" {
+		if _, apierr := a.findProcess(opt.Process); apierr != nil {
+			c.IndentedJSON(apierr.Status, apierr.Model)
+			return
+		}
+	}
+	result, err := a.Procs.Search(opt)
+	if err != nil {
+		log.Printf("failed to search logs: %s", err)
+		c.IndentedJSON(http.StatusInternalServerError, respInternalError)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponseSearchLogs{respOK, result})
+}
+
+// flushWriter flushes the response after each write to stream it
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+	return n, err
+}
+
+func (a *APIServer) ShowQueues(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, APIResponseShowQueues{respOK, a.Pool.ViewModels()})
+}
+
+func (a *APIServer) ShowSchedules(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, APIResponseShowSchedules{respOK, a.Schedules.ViewModels()})
+}
+
+func (a *APIServer) CreateSchedule(c *gin.Context) {
+	var svm ScheduleViewModel
+	if err := c.BindJSON(&svm); err != nil {
+		return
+	}
+	sched := svm.Schedule()
+	if err := a.Schedules.Add(sched); err != nil {
+		log.Printf("failed to add schedule: %s", err)
+		c.IndentedJSON(http.StatusBadRequest, APIResponseModel{Msg: err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponseCreateSchedule{respOK, sched.ID})
+}
+
+func (a *APIServer) ShowSchedule(c *gin.Context) {
+	sched, apierr := a.findSchedule(c.Param("sid"))
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIResponseShowSchedule{respOK, sched.ViewModel()})
+}
+
+func (a *APIServer) DeleteSchedule(c *gin.Context) {
+	sched, apierr := a.findSchedule(c.Param("sid"))
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	if err := a.Schedules.Remove(sched); err != nil {
+		log.Printf("failed to remove schedule %s: %s", sched.ID, err)
+		c.IndentedJSON(http.StatusInternalServerError, respInternalError)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, respOK)
+}
+
+func (a *APIServer) PauseSchedule(c *gin.Context) {
+	a.pauseSchedule(c, true)
+}
+
+func (a *APIServer) ResumeSchedule(c *gin.Context) {
+	a.pauseSchedule(c, false)
+}
+
+func (a *APIServer) pauseSchedule(c *gin.Context, paused bool) {
+	sched, apierr := a.findSchedule(c.Param("sid"))
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	a.Schedules.Pause(sched, paused)
+	c.IndentedJSON(http.StatusOK, APIResponseShowSchedule{respOK, sched.ViewModel()})
+}
+
+func (a *APIServer) findSchedule(sid string) (*Schedule, *APIError) {
+	sched, err := a.Schedules.Find(sid)
+	if err != nil {
+		switch err {
+		case ErrNotUniq:
+			return nil, &APIError{http.StatusConflict, respDuplicated}
+		case ErrScheduleNotFound:
+			return nil, &APIError{http.StatusNotFound, respNotFound}
+		default:
+			log.Printf("failed to find schedule for %s: %s\n", sid, err)
+			return nil, &APIError{http.StatusInternalServerError, respInternalError}
+		}
+	}
+	return sched, nil
 }
 
 func (a *APIServer) findProcess(pid string) (*Process, *APIError) {
@@ -110,13 +551,50 @@ func (a *APIServer) findProcess(pid string) (*Process, *APIError) {
 	return proc, nil
 }
 
-func NewAPIServer() *APIServer {
+// NewAPIServer returns APIServer which keeps processes and their logs
+// under opt.DataDir
+func NewAPIServer(opt *ServerOption) (*APIServer, error) {
+	st, err := store.Open(opt.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	pool := NewPool(opt.MaxConcurrency, opt.Queues)
+	var cgroups *cgroup.Manager
+	if opt.Cgroup != "" {
+		if cgroups, err = cgroup.Setup(opt.Cgroup); err != nil {
+			log.Printf("resource limits are applied with rlimits only: %s", err)
+		}
+	}
+	identities, err := NewIdentities(opt.AllowUsers, opt.AllowGroups)
+	if err != nil {
+		return nil, err
+	}
+	procs, err := NewRegistry(st, filepath.Join(opt.DataDir, "logs"), pool, cgroups, identities, opt.IndexLogs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load processes: %s", err)
+	}
+	schedules, err := NewScheduler(st, procs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schedules: %s", err)
+	}
 	s := &APIServer{
-		Engine: gin.Default(),
-		Procs:  map[string]*Process{},
+		Engine:    gin.Default(),
+		Procs:     procs,
+		Schedules: schedules,
+		Pool:      pool,
 	}
 	s.Setup()
-	return s
+	return s, nil
+}
+
+type APIRequestSignalProc struct {
+	Signal string `json:"signal"`
+}
+
+// WindowSize is the size of a terminal
+type WindowSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
 }
 
 type APIResponseModel struct {
@@ -130,10 +608,50 @@ type APIResponseShowProc struct {
 	APIResponseModel
 	Proc *ProcessViewModel `json:"proc"`
 }
+type APIResponsePruneProcs struct {
+	APIResponseModel
+	PIDs []string `json:"pids"`
+}
+type APIResponseRestartProc struct {
+	APIResponseModel
+	Run int `json:"run"`
+}
+type APIResponseShowRuns struct {
+	APIResponseModel
+	Runs []*RunViewModel `json:"runs"`
+}
+type APIResponseShowRun struct {
+	APIResponseModel
+	Run *RunViewModel `json:"run"`
+}
+type APIResponseShowStats struct {
+	APIResponseModel
+	Stats *StatsViewModel `json:"stats"`
+}
+type APIResponseSearchLogs struct {
+	APIResponseModel
+	*SearchResult
+}
 type APIResponseShowProcs struct {
 	APIResponseModel
 	Procs map[string]*ProcessViewModel `json:"procs"`
 }
+type APIResponseShowQueues struct {
+	APIResponseModel
+	Queues map[string]*QueueViewModel `json:"queues"`
+}
+type APIResponseCreateSchedule struct {
+	APIResponseModel
+	SID string `json:"sid"`
+}
+type APIResponseShowSchedule struct {
+	APIResponseModel
+	Schedule *ScheduleViewModel `json:"schedule"`
+}
+type APIResponseShowSchedules struct {
+	APIResponseModel
+	Schedules map[string]*ScheduleViewModel `json:"schedules"`
+}
 
 type APIError struct {
 	Status int
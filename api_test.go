@@ -0,0 +1,147 @@
+package gj
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestServer returns a server keeping processes under a temporary
+// directory, which is removed by the returned function
+func newTestServer(t *testing.T, opt *ServerOption) (*APIServer, func()) {
+	gin.SetMode(gin.TestMode)
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	opt.DataDir = dir
+	s, err := NewAPIServer(opt)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to create server: %s", err)
+	}
+	return s, func() {
+		s.Procs.writer.flush()
+		os.RemoveAll(dir)
+	}
+}
+
+// request calls the API of s and returns the status
+func request(s *APIServer, method, path, body string, resp interface{}) int {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if resp != nil {
+		json.Unmarshal(w.Body.Bytes(), resp)
+	}
+	return w.Code
+}
+
+// createProc creates and starts the process defined by body and returns it
+func createProc(t *testing.T, s *APIServer, body string) *Process {
+	var created APIResponseCreateProc
+	if status := request(s, "POST", "/api/v1/procs", body, &created); status != http.StatusOK {
+		t.Fatalf("failed to create process: status=%d", status)
+	}
+	if status := request(s, "GET", "/api/v1/procs/"+created.PID+"/start", "", nil); status != http.StatusOK {
+		t.Fatalf("failed to start process: status=%d", status)
+	}
+	proc, err := s.Procs.Find(created.PID)
+	if err != nil {
+		t.Fatalf("failed to find process: %s", err)
+	}
+	return proc
+}
+
+// stopProc stops proc and waits until it finishes
+func stopProc(proc *Process) {
+	_, done := proc.Latest()
+	proc.Stop(0)
+	<-done
+}
+
+func TestStopProcGrace(t *testing.T) {
+	s, cleanup := newTestServer(t, &ServerOption{})
+	defer cleanup()
+	// SIGTERM is ignored, so that the process exits by SIGKILL after grace
+	proc := createProc(t, s, `{"commands": [["sh", "-c", "trap '' TERM; echo ready; sleep 30"]], "kill_grace": "200ms"}`)
+	waitFor(t, "trap", func() bool {
+		var b bytes.Buffer
+		proc.WriteLog(&b, 0, nil)
+		return b.String() == "ready\n"
+	})
+	start := time.Now()
+	if status := request(s, "POST", "/api/v1/procs/"+proc.ID+"/stop", "", nil); status != http.StatusOK {
+		t.Fatalf("failed to stop: status=%d", status)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stop did not default to kill_grace: took %s", d)
+	}
+	_, done := proc.Latest()
+	<-done
+	if state := proc.ViewModel().State; state != StateKilled {
+		t.Errorf("state mismatch: got=%s, expected=%s", state, StateKilled)
+	}
+}
+
+func TestResizeProc(t *testing.T) {
+	s, cleanup := newTestServer(t, &ServerOption{})
+	defer cleanup()
+	pty := createProc(t, s, `{"commands": [["sleep", "30"]], "pty": true}`)
+	noPTY := createProc(t, s, `{"commands": [["sleep", "30"]]}`)
+	finished := createProc(t, s, `{"commands": [["true"]], "pty": true}`)
+	defer stopProc(pty)
+	defer stopProc(noPTY)
+	_, done := finished.Latest()
+	<-done
+	waitFor(t, "running", func() bool { return pty.ViewModel().State == StateRunning })
+	for _, c := range []struct {
+		name   string
+		proc   *Process
+		body   string
+		status int
+	}{
+		{"pty", pty, `{"rows": 40, "cols": 120}`, http.StatusOK},
+		{"zero size", pty, `{"rows": 0, "cols": 120}`, http.StatusBadRequest},
+		{"no pty", noPTY, `{"rows": 40, "cols": 120}`, http.StatusConflict},
+		{"finished", finished, `{"rows": 40, "cols": 120}`, http.StatusConflict},
+	} {
+		if status := request(s, "POST", "/api/v1/procs/"+c.proc.ID+"/resize", c.body, nil); status != c.status {
+			t.Errorf("%s: status mismatch: got=%d, expected=%d", c.name, status, c.status)
+		}
+	}
+	if pvm := pty.ViewModel(); pvm.Rows != 40 || pvm.Cols != 120 {
+		t.Errorf("size mismatch: got=%dx%d, expected=40x120", pvm.Rows, pvm.Cols)
+	}
+	if status := request(s, "POST", "/api/v1/procs/missing/resize", `{"rows": 40, "cols": 120}`, nil); status != http.StatusNotFound {
+		t.Errorf("missing: status mismatch: got=%d, expected=%d", status, http.StatusNotFound)
+	}
+}
+
+func TestCreateProcLimits(t *testing.T) {
+	s, cleanup := newTestServer(t, &ServerOption{})
+	defer cleanup()
+	for _, limits := range []string{`{"cpu": 1}`, `{"pids": 100}`} {
+		if status := request(s, "POST", "/api/v1/procs", `{"commands": [["true"]], "limits": `+limits+`}`, nil); status != http.StatusBadRequest {
+			t.Errorf("%s without cgroups: status mismatch: got=%d, expected=%d", limits, status, http.StatusBadRequest)
+		}
+	}
+	var created APIResponseCreateProc
+	if status := request(s, "POST", "/api/v1/procs", `{"commands": [["true"]], "limits": {"memory": "1G", "open_files": 64}}`, &created); status != http.StatusOK {
+		t.Fatalf("failed to create process: status=%d", status)
+	}
+	var shown APIResponseShowProc
+	request(s, "GET", "/api/v1/procs/"+created.PID, "", &shown)
+	expected := map[string]string{"memory": "rlimit", "open_files": "rlimit"}
+	if !reflect.DeepEqual(shown.Proc.Enforced, expected) {
+		t.Errorf("enforced limits mismatch: got=%v, expected=%v", shown.Proc.Enforced, expected)
+	}
+}
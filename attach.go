@@ -0,0 +1,93 @@
+package gj
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// attachControl is a control message sent as a text message on attach
+type attachControl struct {
+	Type string `json:"type"`
+	WindowSize
+}
+
+// AttachProc bridges a WebSocket to the pty of the process.
+// Binary messages carry terminal data in both directions and text messages
+// carry attachControl from the client.
+func (a *APIServer) AttachProc(c *gin.Context) {
+	pid := c.Param("pid")
+	proc, apierr := a.findProcess(pid)
+	if apierr != nil {
+		c.IndentedJSON(apierr.Status, apierr.Model)
+		return
+	}
+	if !proc.PTY {
+		c.IndentedJSON(http.StatusConflict, respNotPTY)
+		return
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("failed to upgrade connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	in := make(chan []byte)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(in)
+		for {
+			t, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if t == websocket.TextMessage {
+				handleAttachControl(proc, b)
+				continue
+			}
+			select {
+			case in <- b:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	err = proc.Attach(in, func(b []byte) error {
+		return conn.WriteMessage(websocket.BinaryMessage, b)
+	})
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err != nil {
+		log.Printf("failed to attach to %s: %s", proc.ID, err)
+		msg = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
+	}
+	conn.WriteMessage(websocket.CloseMessage, msg)
+}
+
+func handleAttachControl(proc *Process, b []byte) {
+	var ctl attachControl
+	if err := json.Unmarshal(b, &ctl); err != nil {
+		log.Printf("invalid attach control: %s", err)
+		return
+	}
+	switch ctl.Type {
+	case "resize":
+		if ctl.Rows == 0 || ctl.Cols == 0 {
+			return
+		}
+		if err := proc.Resize(ctl.Rows, ctl.Cols); err != nil {
+			log.Printf("failed to resize %s: %s", proc.ID, err)
+		}
+	default:
+		log.Printf("unknown attach control: %s", ctl.Type)
+	}
+}
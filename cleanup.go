@@ -0,0 +1,81 @@
+package gj
+
+import (
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/procstat"
+)
+
+// LeftoverProcess is a process which was still running after its command
+// exited and had to be terminated
+type LeftoverProcess struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+	// Killed is true when it did not exit on SIGTERM within the grace period
+	Killed bool `json:"killed,omitempty"`
+}
+
+// commandTree returns the command whose process ID is pid, members of its
+// process group or session, descendants found before which may have left
+// them, and their descendants. seen maps PIDs of the found descendants to
+// their start time.
+func commandTree(stats []*procstat.Stat, pid int, seen map[int]uint64) []*procstat.Stat {
+	return procstat.Tree(stats, func(s *procstat.Stat) bool {
+		start, ok := seen[s.PID]
+		return s.PID == pid || s.PGID == pid || s.SID == pid || (ok && start == s.Start)
+	})
+}
+
+// cleanup terminates processes left by command i of r after the command,
+// whose process ID is pid, exited
+func (j *Process) cleanup(r *Run, i, pid int) {
+	stats, err := procstat.List()
+	if err != nil {
+		log.Printf("process %s run %d: failed to read /proc: %s", j.ID, r.Number, err)
+		return
+	}
+	j.m.Lock()
+	seen := r.descendants[i]
+	delete(r.descendants, i)
+	j.m.Unlock()
+	left := []*procstat.Stat{}
+	for _, s := range commandTree(stats, pid, seen) {
+		// the command is a zombie until Wait reaps it
+		if s.State != 'Z' {
+			left = append(left, s)
+		}
+	}
+	if len(left) == 0 {
+		return
+	}
+	for _, s := range left {
+		syscall.Kill(s.PID, syscall.SIGTERM)
+	}
+	alive := left
+	for deadline := time.Now().Add(j.killGrace()); len(alive) > 0 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		still := []*procstat.Stat{}
+		for _, s := range alive {
+			if procstat.Alive(s) {
+				still = append(still, s)
+			}
+		}
+		alive = still
+	}
+	killed := map[int]bool{}
+	for _, s := range alive {
+		syscall.Kill(s.PID, syscall.SIGKILL)
+		killed[s.PID] = true
+	}
+	log.Printf("process %s run %d: terminated %d processes left by step %s (%d killed)",
+		j.ID, r.Number, len(left), stepName(j.Commands, i), len(alive))
+	j.m.Lock()
+	defer j.m.Unlock()
+	step := r.Steps[i]
+	for _, s := range left {
+		step.Leftovers = append(step.Leftovers, LeftoverProcess{PID: s.PID, Command: s.Comm, Killed: killed[s.PID]})
+	}
+	j.changed()
+}
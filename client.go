@@ -1,12 +1,19 @@
 package gj
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type Client struct {
@@ -38,6 +45,27 @@ func (c *Client) call(method, path string, body io.Reader) (int, []byte, error)
 	return resp.StatusCode, b, nil
 }
 
+// stream requests path and copies the response body to w as it arrives
+func (c *Client) stream(method, path string, w io.Writer) error {
+	req, err := http.NewRequest(method, c.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %s", err)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request api: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return c.checkStatus(resp.StatusCode, b, "request failed")
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to read body: %s", err)
+	}
+	return nil
+}
+
 func (c *Client) PS() (map[string]*ProcessViewModel, error) {
 	_, b, err := c.call("GET", "/api/v1/procs", nil)
 	if err != nil {
@@ -77,24 +105,395 @@ func (c *Client) Create(r io.Reader) (string, error) {
 	return respModel.PID, nil
 }
 
+func (c *Client) Remove(pid string, force bool) error {
+	status, b, err := c.call("DELETE", fmt.Sprintf("/api/v1/procs/%s?force=%t", pid, force), nil)
+	if err != nil {
+		return fmt.Errorf("failed to Remove request: %s", err)
+	}
+	return c.checkStatus(status, b, "remove failed")
+}
+
+// Prune removes processes in states which finished before olderThan
+// like "7d", or at any time when it is empty, and returns their ids
+func (c *Client) Prune(olderThan, states string) ([]string, error) {
+	q := url.Values{}
+	if olderThan != "" {
+		q.Set("older_than", olderThan)
+	}
+	q.Set("state", states)
+	status, b, err := c.call("DELETE", "/api/v1/procs?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Prune request: %s", err)
+	}
+	// processes removed before a failure are returned with the error
+	respModel := APIResponsePruneProcs{}
+	jsonErr := json.Unmarshal(b, &respModel)
+	if err := c.checkStatus(status, b, "prune failed"); err != nil {
+		return respModel.PIDs, err
+	}
+	if jsonErr != nil {
+		return nil, fmt.Errorf("failed to parse json: %s", jsonErr)
+	}
+	return respModel.PIDs, nil
+}
+
 func (c *Client) Start(pid string) error {
-	status, _, err := c.call("GET", fmt.Sprintf("/api/v1/procs/%s/start", pid), nil)
+	status, b, err := c.call("GET", fmt.Sprintf("/api/v1/procs/%s/start", pid), nil)
 	if err != nil {
 		return fmt.Errorf("failed to Start request: %s", err)
 	}
-	if status != 200 {
-		return errors.New("start failed")
+	return c.checkStatus(status, b, "start failed")
+}
+
+// graceQuery returns the query of grace, which is empty for 0 so that the
+// server uses the kill grace of the process
+func graceQuery(grace time.Duration) string {
+	if grace == 0 {
+		return ""
 	}
-	return nil
+	return "?grace=" + url.QueryEscape(grace.String())
 }
 
-func (c *Client) Log(pid string) (string, error) {
-	_, b, err := c.call("GET", fmt.Sprintf("/api/v1/procs/%s/log", pid), nil)
+// Stop stops the process. grace 0 is the kill grace of the process.
+func (c *Client) Stop(pid string, grace time.Duration) error {
+	path := fmt.Sprintf("/api/v1/procs/%s/stop", pid) + graceQuery(grace)
+	status, b, err := c.call("POST", path, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to Log request: %s", err)
+		return fmt.Errorf("failed to Stop request: %s", err)
+	}
+	return c.checkStatus(status, b, "stop failed")
+}
+
+func (c *Client) Signal(pid, signal string) error {
+	b, err := json.Marshal(APIRequestSignalProc{Signal: signal})
+	if err != nil {
+		return fmt.Errorf("failed to build request: %s", err)
+	}
+	status, b, err := c.call("POST", fmt.Sprintf("/api/v1/procs/%s/signal", pid), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to Signal request: %s", err)
+	}
+	return c.checkStatus(status, b, "signal failed")
+}
+
+// checkStatus returns error with the message of the response for non 200 status
+func (c *Client) checkStatus(status int, b []byte, msg string) error {
+	if status == http.StatusOK {
+		return nil
+	}
+	respModel := APIResponseModel{}
+	if err := json.Unmarshal(b, &respModel); err != nil || respModel.Msg == "" {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s: %s", msg, respModel.Msg)
+}
+
+func (c *Client) Resize(pid string, rows, cols uint16) error {
+	b, err := json.Marshal(WindowSize{Rows: rows, Cols: cols})
+	if err != nil {
+		return fmt.Errorf("failed to build request: %s", err)
+	}
+	status, b, err := c.call("POST", fmt.Sprintf("/api/v1/procs/%s/resize", pid), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to Resize request: %s", err)
 	}
+	return c.checkStatus(status, b, "resize failed")
+}
+
+// Send writes r to stdin of the process and closes stdin when closeStdin is true
+func (c *Client) Send(pid string, r io.Reader, closeStdin bool) error {
+	path := fmt.Sprintf("/api/v1/procs/%s/stdin?close=%t", pid, closeStdin)
+	status, b, err := c.call("POST", path, r)
 	if err != nil {
-		return "", fmt.Errorf("failed to read body: %s", err)
+		return fmt.Errorf("failed to Send request: %s", err)
+	}
+	return c.checkStatus(status, b, "send failed")
+}
+
+// logPath returns the log path of run n, or the latest run for 0
+func logPath(pid string, run int, q url.Values) string {
+	path := fmt.Sprintf("/api/v1/procs/%s/log", pid)
+	if run != 0 {
+		path = fmt.Sprintf("/api/v1/procs/%s/runs/%d/log", pid, run)
+	}
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
+
+// Log returns the log of run, or the latest run for 0
+func (c *Client) Log(pid string, run int, opt *LogOption) (string, error) {
+	status, b, err := c.call("GET", logPath(pid, run, opt.Query()), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to Log request: %s", err)
+	}
+	if err := c.checkStatus(status, b, "log failed"); err != nil {
+		return "", err
 	}
 	return string(b), nil
 }
+
+// FollowLog writes the log to w until the run finishes
+func (c *Client) FollowLog(pid string, run int, w io.Writer, opt *LogOption) error {
+	q := opt.Query()
+	q.Set("follow", "true")
+	if err := c.stream("GET", logPath(pid, run, q), w); err != nil {
+		return fmt.Errorf("failed to Log request: %s", err)
+	}
+	return nil
+}
+
+// Restart starts a new run of the process and returns its number. An
+// active run is stopped first with grace, where 0 is the kill grace of the
+// process.
+func (c *Client) Restart(pid string, grace time.Duration) (int, error) {
+	path := fmt.Sprintf("/api/v1/procs/%s/restart", pid) + graceQuery(grace)
+	status, b, err := c.call("POST", path, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to Restart request: %s", err)
+	}
+	if err := c.checkStatus(status, b, "restart failed"); err != nil {
+		return 0, err
+	}
+	respModel := APIResponseRestartProc{}
+	if err := json.Unmarshal(b, &respModel); err != nil {
+		return 0, fmt.Errorf("failed to parse json: %s", err)
+	}
+	return respModel.Run, nil
+}
+
+// ShowRun returns run n of the process
+func (c *Client) ShowRun(pid string, n int) (*RunViewModel, error) {
+	status, b, err := c.call("GET", fmt.Sprintf("/api/v1/procs/%s/runs/%d", pid, n), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ShowRun request: %s", err)
+	}
+	if err := c.checkStatus(status, b, "show run failed"); err != nil {
+		return nil, err
+	}
+	respModel := APIResponseShowRun{}
+	if err := json.Unmarshal(b, &respModel); err != nil {
+		return nil, fmt.Errorf("failed to parse json: %s", err)
+	}
+	return respModel.Run, nil
+}
+
+// Stats returns resource usage of run n of the process, or the latest run for 0
+func (c *Client) Stats(pid string, n int) (*StatsViewModel, error) {
+	status, b, err := c.call("GET", fmt.Sprintf("/api/v1/procs/%s/stats?run=%d", pid, n), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Stats request: %s", err)
+	}
+	if err := c.checkStatus(status, b, "show stats failed"); err != nil {
+		return nil, err
+	}
+	respModel := APIResponseShowStats{}
+	if err := json.Unmarshal(b, &respModel); err != nil {
+		return nil, fmt.Errorf("failed to parse json: %s", err)
+	}
+	return respModel.Stats, nil
+}
+
+// Search searches logs of processes
+func (c *Client) Search(opt *SearchOption) (*SearchResult, error) {
+	status, b, err := c.call("GET", "/api/v1/logs/search?"+opt.Query().Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Search request: %s", err)
+	}
+	if err := c.checkStatus(status, b, "search failed"); err != nil {
+		return nil, err
+	}
+	respModel := APIResponseSearchLogs{}
+	if err := json.Unmarshal(b, &respModel); err != nil {
+		return nil, fmt.Errorf("failed to parse json: %s", err)
+	}
+	return respModel.SearchResult, nil
+}
+
+func (c *Client) Schedules() (map[string]*ScheduleViewModel, error) {
+	status, b, err := c.call("GET", "/api/v1/schedules", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Schedules request: %s", err)
+	}
+	if err := c.checkStatus(status, b, "list schedules failed"); err != nil {
+		return nil, err
+	}
+	respModel := APIResponseShowSchedules{}
+	if err := json.Unmarshal(b, &respModel); err != nil {
+		return nil, fmt.Errorf("failed to parse json: %s", err)
+	}
+	return respModel.Schedules, nil
+}
+
+// CreateSchedule registers a schedule and returns its id
+func (c *Client) CreateSchedule(svm *ScheduleViewModel) (string, error) {
+	b, err := json.Marshal(svm)
+	if err != nil {
+		return "", fmt.Errorf("failed to build request: %s", err)
+	}
+	status, b, err := c.call("POST", "/api/v1/schedules", bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("failed to CreateSchedule request: %s", err)
+	}
+	if err := c.checkStatus(status, b, "create schedule failed"); err != nil {
+		return "", err
+	}
+	respModel := APIResponseCreateSchedule{}
+	if err := json.Unmarshal(b, &respModel); err != nil {
+		return "", fmt.Errorf("failed to parse json: %s", err)
+	}
+	return respModel.SID, nil
+}
+
+func (c *Client) RemoveSchedule(sid string) error {
+	status, b, err := c.call("DELETE", fmt.Sprintf("/api/v1/schedules/%s", sid), nil)
+	if err != nil {
+		return fmt.Errorf("failed to RemoveSchedule request: %s", err)
+	}
+	return c.checkStatus(status, b, "remove schedule failed")
+}
+
+// PauseSchedule pauses the schedule, or resumes it when paused is false
+func (c *Client) PauseSchedule(sid string, paused bool) error {
+	action := "pause"
+	if !paused {
+		action = "resume"
+	}
+	status, b, err := c.call("POST", fmt.Sprintf("/api/v1/schedules/%s/%s", sid, action), nil)
+	if err != nil {
+		return fmt.Errorf("failed to PauseSchedule request: %s", err)
+	}
+	return c.checkStatus(status, b, action+" schedule failed")
+}
+
+// AttachOption configures Client.Attach
+type AttachOption struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	// DetachKeys is the key sequence typed to detach
+	DetachKeys []byte
+	// Resize receives window sizes to apply to the pty
+	Resize <-chan WindowSize
+}
+
+// Attach connects stdin and stdout to the pty of the process. When
+// detach keys are typed it returns with detached true leaving the process
+// running.
+func (c *Client) Attach(pid string, opt *AttachOption) (detached bool, err error) {
+	u := "ws" + strings.TrimPrefix(c.url, "http") + fmt.Sprintf("/api/v1/procs/%s/attach", pid)
+	ws, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		if resp != nil {
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return false, c.checkStatus(resp.StatusCode, b, "attach failed")
+		}
+		return false, fmt.Errorf("failed to connect: %s", err)
+	}
+	defer ws.Close()
+	conn := &wsConn{Conn: ws}
+
+	detach := make(chan struct{})
+	go func() {
+		w := &detachWriter{conn: conn, keys: opt.DetachKeys}
+		if _, err := io.Copy(w, opt.Stdin); err == errDetached {
+			close(detach)
+		}
+	}()
+	go func() {
+		for size := range opt.Resize {
+			b, err := json.Marshal(attachControl{Type: "resize", WindowSize: size})
+			if err != nil {
+				continue
+			}
+			if err := conn.write(websocket.TextMessage, b); err != nil {
+				return
+			}
+		}
+	}()
+	output := make(chan error, 1)
+	go func() {
+		for {
+			_, b, err := ws.ReadMessage()
+			if err != nil {
+				output <- err
+				return
+			}
+			if _, err := opt.Stdout.Write(b); err != nil {
+				output <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-detach:
+		conn.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		return true, nil
+	case err := <-output:
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return false, nil
+		}
+		if ce, ok := err.(*websocket.CloseError); ok {
+			return false, fmt.Errorf("attach failed: %s", ce.Text)
+		}
+		return false, err
+	}
+}
+
+// wsConn serializes writes to the connection
+type wsConn struct {
+	*websocket.Conn
+	m sync.Mutex
+}
+
+func (c *wsConn) write(messageType int, b []byte) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.WriteMessage(messageType, b)
+}
+
+var errDetached = errors.New("detached")
+
+// detachWriter sends written bytes to conn until the detach keys are typed.
+// Bytes matching a prefix of the keys are held until the match fails.
+type detachWriter struct {
+	conn    *wsConn
+	keys    []byte
+	matched int
+}
+
+func (w *detachWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+len(w.keys))
+	for _, b := range p {
+		if w.matched < len(w.keys) && b == w.keys[w.matched] {
+			w.matched++
+			if w.matched == len(w.keys) {
+				// input typed before the keys is still sent
+				if err := w.send(buf); err != nil {
+					return 0, err
+				}
+				return len(p), errDetached
+			}
+			continue
+		}
+		buf = append(buf, w.keys[:w.matched]...)
+		w.matched = 0
+		if len(w.keys) > 1 && b == w.keys[0] {
+			w.matched = 1
+			continue
+		}
+		buf = append(buf, b)
+	}
+	if err := w.send(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *detachWriter) send(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return w.conn.write(websocket.BinaryMessage, b)
+}
@@ -0,0 +1,152 @@
+package gj
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// detachServer returns a server which collects binary messages until the
+// connection is closed and sends them to received
+func detachServer(received chan<- []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var buf bytes.Buffer
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				received <- buf.Bytes()
+				return
+			}
+			buf.Write(b)
+		}
+	}))
+}
+
+func TestDetachWriter(t *testing.T) {
+	keys := []byte{0x10, 0x11}
+	for _, c := range []struct {
+		name     string
+		writes   []string
+		sent     string
+		detached bool
+	}{
+		{"no keys", []string{"ls\n"}, "ls\n", false},
+		{"keys", []string{"\x10\x11"}, "", true},
+		{"input before keys", []string{"ls\x10\x11"}, "ls", true},
+		{"keys split", []string{"ls\x10", "\x11"}, "ls", true},
+		{"keys split with input", []string{"l", "s\x10", "\x11rest"}, "ls", true},
+		{"partial keys", []string{"ls\x10", "x"}, "ls\x10x", false},
+		{"partial keys again", []string{"\x10", "\x10\x11"}, "\x10", true},
+	} {
+		received := make(chan []byte, 1)
+		s := detachServer(received)
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err)
+		}
+		w := &detachWriter{conn: &wsConn{Conn: ws}, keys: keys}
+		detached := false
+		for _, b := range c.writes {
+			if _, err := w.Write([]byte(b)); err == errDetached {
+				detached = true
+				break
+			} else if err != nil {
+				t.Fatalf("%s: failed to write: %s", c.name, err)
+			}
+		}
+		ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		select {
+		case b := <-received:
+			if string(b) != c.sent {
+				t.Errorf("%s: sent mismatch: got=%q, expected=%q", c.name, b, c.sent)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: server did not receive", c.name)
+		}
+		if detached != c.detached {
+			t.Errorf("%s: detached mismatch: got=%v, expected=%v", c.name, detached, c.detached)
+		}
+		ws.Close()
+		s.Close()
+	}
+}
+
+func TestPrunePartial(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "internal error", "pids": ["a", "b"]}`))
+	}))
+	defer s.Close()
+	pids, err := NewClient(s.URL).Prune("", "finished")
+	if err == nil {
+		t.Fatal("error not returned")
+	}
+	if !reflect.DeepEqual(pids, []string{"a", "b"}) {
+		t.Errorf("pids mismatch: got=%v, expected=%v", pids, []string{"a", "b"})
+	}
+}
+
+func TestClientStopGrace(t *testing.T) {
+	s, cleanup := newTestServer(t, &ServerOption{})
+	defer cleanup()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	// SIGTERM is ignored, so that the process exits by SIGKILL after grace
+	proc := createProc(t, s, `{"commands": [["sh", "-c", "trap '' TERM; echo ready; sleep 30"]], "kill_grace": "200ms"}`)
+	waitFor(t, "trap", func() bool {
+		var b bytes.Buffer
+		proc.WriteLog(&b, 0, nil)
+		return b.String() == "ready\n"
+	})
+	start := time.Now()
+	if err := NewClient(hs.URL).Stop(proc.ID, 0); err != nil {
+		t.Fatalf("failed to stop: %s", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stop did not default to kill_grace: took %s", d)
+	}
+	_, done := proc.Latest()
+	<-done
+	if state := proc.ViewModel().State; state != StateKilled {
+		t.Errorf("state mismatch: got=%s, expected=%s", state, StateKilled)
+	}
+}
+
+func TestClientRestartGrace(t *testing.T) {
+	s, cleanup := newTestServer(t, &ServerOption{})
+	defer cleanup()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	proc := createProc(t, s, `{"commands": [["sh", "-c", "trap '' TERM; echo ready; sleep 30"]], "kill_grace": "200ms"}`)
+	defer stopProc(proc)
+	waitFor(t, "trap", func() bool {
+		var b bytes.Buffer
+		proc.WriteLog(&b, 0, nil)
+		return b.String() == "ready\n"
+	})
+	start := time.Now()
+	n, err := NewClient(hs.URL).Restart(proc.ID, 0)
+	if err != nil {
+		t.Fatalf("failed to restart: %s", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("restart did not default to kill_grace: took %s", d)
+	}
+	if n != 2 {
+		t.Errorf("run mismatch: got=%d, expected=2", n)
+	}
+	if rvm, _ := proc.RunViewModel(1); rvm.State != StateKilled {
+		t.Errorf("state of run 1 mismatch: got=%s, expected=%s", rvm.State, StateKilled)
+	}
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+	"golang.org/x/term"
+)
+
+func init() {
+	RootCmd.AddCommand(AttachCmd)
+	AttachCmd.Flags().StringVar(&detachKeys, "detach-keys", "ctrl-p,ctrl-q", "key sequence to detach from the process")
+}
+
+var detachKeys string
+
+var AttachCmd = &cobra.Command{
+	Use:   "attach",
+	Short: "Attach terminal to process",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("pid required")
+		}
+		keys, err := parseDetachKeys(detachKeys)
+		if err != nil {
+			log.Fatalf("invalid detach keys: %s", err)
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		fd := int(os.Stdin.Fd())
+		if term.IsTerminal(fd) {
+			state, err := term.MakeRaw(fd)
+			if err != nil {
+				log.Fatalf("failed to set terminal raw mode: %s", err)
+			}
+			defer term.Restore(fd, state)
+		}
+		opt := &gj.AttachOption{
+			Stdin:      os.Stdin,
+			Stdout:     os.Stdout,
+			DetachKeys: keys,
+		}
+		if term.IsTerminal(fd) {
+			opt.Resize = watchWindowSize(fd)
+		}
+		detached, err := client.Attach(args[0], opt)
+		if err != nil {
+			log.Printf("error: %s\r", err)
+			return
+		}
+		if detached {
+			fmt.Print("\r\ndetached\r\n")
+		}
+	},
+}
+
+// parseDetachKeys parses comma separated keys like "ctrl-p,ctrl-q"
+func parseDetachKeys(s string) ([]byte, error) {
+	keys := []byte{}
+	for _, k := range strings.Split(s, ",") {
+		switch {
+		case len(k) == 1:
+			keys = append(keys, k[0])
+		case len(k) == 6 && strings.HasPrefix(k, "ctrl-"):
+			c := k[5]
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c < '@' || c > 'z' {
+				return nil, fmt.Errorf("unknown key: %s", k)
+			}
+			keys = append(keys, c&0x1f)
+		default:
+			return nil, fmt.Errorf("unknown key: %s", k)
+		}
+	}
+	return keys, nil
+}
+
+// watchWindowSize sends the current size of the terminal and sends it again
+// on every SIGWINCH
+func watchWindowSize(fd int) <-chan gj.WindowSize {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	sizes := make(chan gj.WindowSize, 1)
+	go func() {
+		for {
+			if cols, rows, err := term.GetSize(fd); err == nil {
+				sizes <- gj.WindowSize{Rows: uint16(rows), Cols: uint16(cols)}
+			}
+			<-sigs
+		}
+	}()
+	return sizes
+}
@@ -5,9 +5,11 @@ import (
 	"os"
 
 	"github.com/yoru9zine/gj/cmd"
+	"github.com/yoru9zine/gj/pkg/execute"
 )
 
 func main() {
+	execute.Init()
 	if err := cmd.RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
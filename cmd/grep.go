@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(GrepCmd)
+	GrepCmd.Flags().BoolVarP(&grepFixed, "fixed-strings", "F", false, "match the pattern as a literal string")
+	GrepCmd.Flags().BoolVarP(&grepIgnoreCase, "ignore-case", "i", false, "ignore case")
+	GrepCmd.Flags().IntVarP(&grepContext, "context", "C", 0, "lines to show before and after each match")
+	GrepCmd.Flags().StringVar(&grepStream, "stream", "", "search stdout or stderr only")
+	GrepCmd.Flags().StringVar(&grepProc, "proc", "", "search the process of this ID only")
+	GrepCmd.Flags().StringVar(&grepSince, "since", "", "search output written since RFC 3339 time or age like 10m or 2d")
+	GrepCmd.Flags().StringVar(&grepUntil, "until", "", "search output written until RFC 3339 time or age like 10m or 2d")
+	GrepCmd.Flags().IntVar(&grepLimit, "limit", 0, "max matches (default 1000)")
+}
+
+var (
+	grepFixed      bool
+	grepIgnoreCase bool
+	grepContext    int
+	grepStream     string
+	grepProc       string
+	grepSince      string
+	grepUntil      string
+	grepLimit      int
+)
+
+// shortIDLength is the length of process IDs in output of grep
+const shortIDLength = 12
+
+var GrepCmd = &cobra.Command{
+	Use:   "grep <pattern>",
+	Short: "Search logs of all processes",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("pattern required")
+		}
+		opt := &gj.SearchOption{
+			Pattern:    args[0],
+			Fixed:      grepFixed,
+			IgnoreCase: grepIgnoreCase,
+			Context:    grepContext,
+			Stream:     grepStream,
+			Process:    grepProc,
+			Limit:      grepLimit,
+		}
+		now := time.Now()
+		var err error
+		if grepSince != "" {
+			if opt.Since, err = gj.ParseLogTime(grepSince, now); err != nil {
+				log.Fatalf("error: %s", err)
+			}
+		}
+		if grepUntil != "" {
+			if opt.Until, err = gj.ParseLogTime(grepUntil, now); err != nil {
+				log.Fatalf("error: %s", err)
+			}
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		result, err := client.Search(opt)
+		if err != nil {
+			log.Fatalf("error: %s", err)
+		}
+		printMatches(result.Matches, grepContext > 0)
+		if result.Truncated {
+			fmt.Fprintf(os.Stderr, "more matches were found than the limit of %d\n", len(result.Matches))
+		}
+		if len(result.Matches) == 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+type grepLine struct {
+	text  string
+	match bool
+}
+
+// printMatches prints matches like grep, with ":" around the line number
+// of matches and "-" around that of context lines. Lines in context of
+// several matches are printed once, and "--" separates groups of lines.
+// Lines of a run are printed by stream.
+func printMatches(matches []*gj.LogMatch, context bool) {
+	var (
+		run     string
+		printed bool
+		streams = map[string]map[int]*grepLine{}
+	)
+	flush := func() {
+		for _, stream := range []string{"stdout", "stderr"} {
+			lines := streams[stream]
+			ns := []int{}
+			for n := range lines {
+				ns = append(ns, n)
+			}
+			sort.Ints(ns)
+			prev := 0
+			for _, n := range ns {
+				if context && printed && n != prev+1 {
+					fmt.Println("--")
+				}
+				l := lines[n]
+				sep := "-"
+				if l.match {
+					sep = ":"
+				}
+				fmt.Printf("%s/%s%s%d%s%s\n", run, stream, sep, n, sep, l.text)
+				printed = true
+				prev = n
+			}
+		}
+		streams = map[string]map[int]*grepLine{}
+	}
+	for _, m := range matches {
+		id := m.Process
+		if len(id) > shortIDLength {
+			id = id[:shortIDLength]
+		}
+		if r := fmt.Sprintf("%s/%d", id, m.Run); r != run {
+			flush()
+			run = r
+		}
+		lines := streams[m.Stream]
+		if lines == nil {
+			lines = map[int]*grepLine{}
+			streams[m.Stream] = lines
+		}
+		first := m.Line - len(m.Before)
+		for i, text := range m.Before {
+			if lines[first+i] == nil {
+				lines[first+i] = &grepLine{text: text}
+			}
+		}
+		lines[m.Line] = &grepLine{text: m.Text, match: true}
+		for i, text := range m.After {
+			if lines[m.Line+1+i] == nil {
+				lines[m.Line+1+i] = &grepLine{text: text}
+			}
+		}
+	}
+	flush()
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(KillCmd)
+	KillCmd.Flags().StringVarP(&killSignal, "signal", "s", "KILL", "signal to send")
+}
+
+var killSignal string
+
+var KillCmd = &cobra.Command{
+	Use:   "kill",
+	Short: "Send signal to process",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("pid required")
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		if err := client.Signal(args[0], killSignal); err != nil {
+			log.Fatalf("error: %s", err)
+		}
+	},
+}
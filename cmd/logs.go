@@ -3,6 +3,8 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/yoru9zine/gj"
@@ -10,8 +12,21 @@ import (
 
 func init() {
 	RootCmd.AddCommand(LogsCmd)
+	LogsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "follow log output and exit with the exit code of the process")
+	LogsCmd.Flags().IntVarP(&logsRun, "run", "r", 0, "run number (default latest)")
+	LogsCmd.Flags().BoolVarP(&logsTimestamps, "timestamps", "t", false, "prefix each line with the time it was written")
+	LogsCmd.Flags().StringVar(&logsSince, "since", "", "show output written since RFC 3339 time or age like 10m or 2d")
+	LogsCmd.Flags().StringVar(&logsUntil, "until", "", "show output written until RFC 3339 time or age like 10m or 2d")
 }
 
+var (
+	logsFollow     bool
+	logsRun        int
+	logsTimestamps bool
+	logsSince      string
+	logsUntil      string
+)
+
 var LogsCmd = &cobra.Command{
 	Use:   "logs",
 	Short: "Show process log",
@@ -19,11 +34,43 @@ var LogsCmd = &cobra.Command{
 		if len(args) != 1 {
 			log.Fatal("pid required")
 		}
+		opt := &gj.LogOption{Timestamps: logsTimestamps}
+		now := time.Now()
+		var err error
+		if logsSince != "" {
+			if opt.Since, err = gj.ParseLogTime(logsSince, now); err != nil {
+				log.Fatalf("error: %s", err)
+			}
+		}
+		if logsUntil != "" {
+			if opt.Until, err = gj.ParseLogTime(logsUntil, now); err != nil {
+				log.Fatalf("error: %s", err)
+			}
+		}
 		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
-		logstring, err := client.Log(args[0])
+		if logsFollow {
+			// the latest run may change by a restart while following
+			n := logsRun
+			if n == 0 {
+				run, err := client.ShowRun(args[0], 0)
+				if err != nil {
+					log.Fatalf("error: %s", err)
+				}
+				n = run.Run
+			}
+			if err := client.FollowLog(args[0], n, os.Stdout, opt); err != nil {
+				log.Fatalf("error: %s", err)
+			}
+			run, err := client.ShowRun(args[0], n)
+			if err != nil {
+				log.Fatalf("error: %s", err)
+			}
+			os.Exit(run.ExitCode())
+		}
+		logstring, err := client.Log(args[0], logsRun, opt)
 		if err != nil {
 			log.Fatalf("error: %s", err)
 		}
-		fmt.Printf(logstring)
+		fmt.Print(logstring)
 	},
 }
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(PruneCmd)
+	PruneCmd.Flags().StringVar(&pruneOlderThan, "older-than", "", "remove processes finished before this duration like 12h or 7d (default any time)")
+	PruneCmd.Flags().StringVar(&pruneState, "state", "finished", "comma separated states to remove")
+}
+
+var (
+	pruneOlderThan string
+	pruneState     string
+)
+
+var PruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove finished processes and their logs",
+	Run: func(cmd *cobra.Command, args []string) {
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		pids, err := client.Prune(pruneOlderThan, pruneState)
+		for _, pid := range pids {
+			fmt.Println(pid)
+		}
+		if err != nil {
+			log.Fatalf("error: %s", err)
+		}
+	},
+}
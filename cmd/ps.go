@@ -22,7 +22,7 @@ var PSCmd = &cobra.Command{
 			log.Fatalf("error: %s", err)
 		}
 		for _, proc := range models {
-			fmt.Printf("%s\t%s\n", proc.ID, proc.Name)
+			fmt.Printf("%s\t%s\t%s\n", proc.ID, proc.Name, proc.State)
 		}
 	},
 }
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(RerunCmd)
+	RerunCmd.Flags().DurationVarP(&rerunGrace, "time", "t", 0, "time to wait before killing the active run (default kill_grace of the process)")
+}
+
+var rerunGrace time.Duration
+
+var RerunCmd = &cobra.Command{
+	Use:   "rerun",
+	Short: "Start a new run of process",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("pid required")
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		n, err := client.Restart(args[0], rerunGrace)
+		if err != nil {
+			log.Fatalf("error: %s", err)
+		}
+		fmt.Printf("run %d\n", n)
+	},
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(RmCmd)
+	RmCmd.Flags().BoolVarP(&rmForce, "force", "f", false, "kill and remove active process")
+}
+
+var rmForce bool
+
+var RmCmd = &cobra.Command{
+	Use:   "rm",
+	Short: "Remove process and its logs",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			log.Fatal("pid required")
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		for _, pid := range args {
+			if err := client.Remove(pid, rmForce); err != nil {
+				log.Fatalf("error: %s: %s", pid, err)
+			}
+			fmt.Println(pid)
+		}
+	},
+}
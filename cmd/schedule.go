@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(ScheduleCmd)
+	ScheduleCmd.AddCommand(ScheduleLsCmd, ScheduleAddCmd, ScheduleRmCmd, SchedulePauseCmd, ScheduleResumeCmd)
+	ScheduleAddCmd.Flags().StringVar(&scheduleName, "name", "", "schedule name")
+	ScheduleAddCmd.Flags().StringVar(&scheduleTimezone, "tz", "", "timezone of the cron expression like Asia/Tokyo (default local)")
+	ScheduleAddCmd.Flags().StringVar(&scheduleOverlap, "overlap", gj.OverlapSkip, "skip, queue or allow when the previous process is active")
+}
+
+var (
+	scheduleName     string
+	scheduleTimezone string
+	scheduleOverlap  string
+)
+
+var ScheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Manage scheduled processes",
+}
+
+var ScheduleLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "Show schedule list",
+	Run: func(cmd *cobra.Command, args []string) {
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		models, err := client.Schedules()
+		if err != nil {
+			log.Fatalf("error: %s", err)
+		}
+		for _, s := range models {
+			next := "paused"
+			if !s.Paused && s.NextFire != nil {
+				next = s.NextFire.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", s.ID, s.Name, s.Cron, s.Overlap, next)
+		}
+	},
+}
+
+var ScheduleAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add schedule which creates the process at times of cron expression",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatal("cron expression and process file required")
+		}
+		b, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			log.Fatalf("failed to read file %s: %s", args[1], err)
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		sid, err := client.CreateSchedule(&gj.ScheduleViewModel{
+			Name:     scheduleName,
+			Cron:     args[0],
+			Timezone: scheduleTimezone,
+			Overlap:  scheduleOverlap,
+			Process:  b,
+		})
+		if err != nil {
+			log.Fatalf("error: %s", err)
+		}
+		fmt.Printf("%s\n", sid)
+	},
+}
+
+var ScheduleRmCmd = &cobra.Command{
+	Use:   "rm",
+	Short: "Remove schedules. Processes created by them are kept.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			log.Fatal("sid required")
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		for _, sid := range args {
+			if err := client.RemoveSchedule(sid); err != nil {
+				log.Fatalf("error: %s: %s", sid, err)
+			}
+			fmt.Println(sid)
+		}
+	},
+}
+
+var SchedulePauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "Pause schedule",
+	Run: func(cmd *cobra.Command, args []string) {
+		pauseSchedule(args, true)
+	},
+}
+
+var ScheduleResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume paused schedule",
+	Run: func(cmd *cobra.Command, args []string) {
+		pauseSchedule(args, false)
+	},
+}
+
+func pauseSchedule(args []string, paused bool) {
+	if len(args) != 1 {
+		log.Fatal("sid required")
+	}
+	client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+	if err := client.PauseSchedule(args[0], paused); err != nil {
+		log.Fatalf("error: %s", err)
+	}
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(SendCmd)
+	SendCmd.Flags().BoolVarP(&sendNoNewline, "no-newline", "n", false, "do not append newline to text")
+	SendCmd.Flags().BoolVar(&sendClose, "close", false, "close stdin after sending")
+}
+
+var (
+	sendNoNewline bool
+	sendClose     bool
+)
+
+var SendCmd = &cobra.Command{
+	Use:   "send <pid> <text|->",
+	Short: "Send input to process stdin",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatal("pid and text required")
+		}
+		var r io.Reader
+		if args[1] == "-" {
+			r = os.Stdin
+		} else {
+			text := args[1]
+			if !sendNoNewline {
+				text += "\n"
+			}
+			r = strings.NewReader(text)
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		if err := client.Send(args[0], r, sendClose); err != nil {
+			log.Fatalf("error: %s", err)
+		}
+	},
+}
@@ -2,6 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"github.com/yoru9zine/gj"
@@ -9,13 +12,55 @@ import (
 
 func init() {
 	RootCmd.AddCommand(ServerCmd)
+	ServerCmd.Flags().StringVar(&dataDir, "data-dir", defaultDataDir(), "directory to store processes and their logs")
+	ServerCmd.Flags().IntVar(&maxConcurrency, "max-concurrency", 0, "max runs executing at once (0 is unlimited)")
+	ServerCmd.Flags().StringArrayVar(&queues, "queue", nil, "queue definition like name:limit:priority (repeatable)")
+	ServerCmd.Flags().StringArrayVar(&allowUsers, "allow-user", nil, "user which processes may run as (repeatable)")
+	ServerCmd.Flags().StringArrayVar(&allowGroups, "allow-group", nil, "group which processes may run as (repeatable)")
+	ServerCmd.Flags().BoolVar(&indexLogs, "index-logs", false, "save search indexes of logs of finished runs")
+	ServerCmd.Flags().StringVar(&cgroupDir, "cgroup", "", "writable cgroup v2 directory for runs with limits (default none). If it is the cgroup of the server, the server moves into its \"server\" child")
+}
+
+var (
+	dataDir        string
+	maxConcurrency int
+	queues         []string
+	cgroupDir      string
+	allowUsers     []string
+	allowGroups    []string
+	indexLogs      bool
+)
+
+func defaultDataDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".gj")
+	}
+	return filepath.Join(os.TempDir(), "gj")
 }
 
 var ServerCmd = &cobra.Command{
 	Use:   "server",
 	Short: "start server",
 	Run: func(cmd *cobra.Command, args []string) {
-		srv := gj.NewAPIServer()
+		opt := &gj.ServerOption{
+			DataDir:        dataDir,
+			MaxConcurrency: maxConcurrency,
+			Cgroup:         cgroupDir,
+			AllowUsers:     allowUsers,
+			AllowGroups:    allowGroups,
+			IndexLogs:      indexLogs,
+		}
+		for _, s := range queues {
+			q, err := gj.ParseQueue(s)
+			if err != nil {
+				log.Fatalf("error: %s", err)
+			}
+			opt.Queues = append(opt.Queues, q)
+		}
+		srv, err := gj.NewAPIServer(opt)
+		if err != nil {
+			log.Fatalf("failed to start server: %s", err)
+		}
 		srv.Run(fmt.Sprintf(":%d", port))
 	},
 }
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+)
+
+func init() {
+	RootCmd.AddCommand(StopCmd)
+	StopCmd.Flags().DurationVarP(&stopGrace, "time", "t", 0, "time to wait before killing the process (default kill_grace of the process)")
+}
+
+var stopGrace time.Duration
+
+var StopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop process",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("pid required")
+		}
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		if err := client.Stop(args[0], stopGrace); err != nil {
+			log.Fatalf("error: %s", err)
+		}
+		fmt.Println("stopped")
+	},
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yoru9zine/gj"
+	"golang.org/x/term"
+)
+
+func init() {
+	RootCmd.AddCommand(TopCmd)
+	TopCmd.Flags().DurationVarP(&topDelay, "delay", "d", 2*time.Second, "interval between updates")
+	TopCmd.Flags().IntVarP(&topIterations, "iterations", "n", 0, "number of updates before exit (0 is unlimited)")
+}
+
+var (
+	topDelay      time.Duration
+	topIterations int
+)
+
+var TopCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show resource usage of running processes",
+	Run: func(cmd *cobra.Command, args []string) {
+		client := gj.NewClient(fmt.Sprintf("http://localhost:%d", port))
+		clear := term.IsTerminal(int(os.Stdout.Fd()))
+		for i := 0; topIterations == 0 || i < topIterations; i++ {
+			if i > 0 {
+				time.Sleep(topDelay)
+			}
+			rows, err := topRows(client)
+			if err != nil {
+				log.Fatalf("error: %s", err)
+			}
+			if clear {
+				fmt.Print("\033[H\033[2J")
+			}
+			fmt.Printf("%-12s\t%-20s\t%4s\t%6s\t%9s\t%5s\t%9s\t%9s\n", "ID", "NAME", "RUN", "CPU%", "RSS", "PROCS", "READ", "WRITE")
+			for _, r := range rows {
+				s := r.stats.Current
+				fmt.Printf("%-12.12s\t%-20.20s\t%4d\t%6.1f\t%9s\t%5d\t%9s\t%9s\n",
+					r.proc.ID, r.proc.Name, r.stats.Run, s.CPUPercent, formatBytes(s.RSS), s.Processes, formatBytes(s.ReadBytes), formatBytes(s.WriteBytes))
+			}
+		}
+	},
+}
+
+type topRow struct {
+	proc  *gj.ProcessViewModel
+	stats *gj.StatsViewModel
+}
+
+// topRows returns running processes which have a sample, in descending order of CPU usage
+func topRows(client *gj.Client) ([]topRow, error) {
+	procs, err := client.PS()
+	if err != nil {
+		return nil, err
+	}
+	rows := []topRow{}
+	for _, proc := range procs {
+		if proc.State != gj.StateRunning {
+			continue
+		}
+		stats, err := client.Stats(proc.ID, 0)
+		if err != nil || stats.Current == nil {
+			// finished or not sampled yet
+			continue
+		}
+		rows = append(rows, topRow{proc, stats})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].stats.Current.CPUPercent > rows[j].stats.Current.CPUPercent
+	})
+	return rows, nil
+}
+
+func formatBytes(b gj.ByteSize) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	n, exp := float64(b)/unit, 0
+	for n >= unit && exp < 3 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ci", n, "KMGT"[exp])
+}
@@ -1,23 +1,114 @@
 package gj
 
 import (
-	"io"
-	"os/exec"
+	"encoding/json"
+	"fmt"
+	"syscall"
 
-	"github.com/kr/pty"
+	"github.com/yoru9zine/gj/pkg/execute"
 )
 
 type Command struct {
 	Name string
 	Args []string
+	// Step is the name of the command in its process. Needs are steps which
+	// must succeed before it starts. A command in sequence needs the
+	// previous command instead.
+	Step     string
+	Needs    []string
+	Sequence bool
 }
 
-func (c *Command) Start(opt *CommandOption) (io.Writer, io.Reader, io.Reader, *exec.Cmd, error) {
-	cmd := exec.Command(c.Name, c.Args...)
-	f, err := pty.Start(cmd)
-	return f, f, nil, cmd, err
+func (c *Command) Start(opt *CommandOption) (*execute.Process, error) {
+	p, err := execute.NewProcess(&execute.ProcessOption{
+		Env:         opt.Env,
+		WorkDir:     opt.Dir,
+		AllocatePTY: opt.PTY,
+		Rows:        opt.Rows,
+		Cols:        opt.Cols,
+		Logger:      opt.Logger,
+		Rlimits:     opt.Rlimits,
+		CgroupDir:   opt.CgroupDir,
+		Credential:  opt.Credential,
+		Cleanup:     opt.Cleanup,
+		Step:        opt.Step,
+	}, append([]string{c.Name}, c.Args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 type CommandOption struct {
-	PTY bool
+	PTY    bool
+	Rows   uint16
+	Cols   uint16
+	Dir    string
+	Env    []string
+	Logger *execute.ProcessLogWriter
+	// Step is the index of the command recorded in the log
+	Step int
+
+	Rlimits   []execute.Rlimit
+	CgroupDir string
+	// Credential is the identity of the command. nil runs as the server.
+	Credential *syscall.Credential
+	// Cleanup terminates processes left by the command after it exits
+	Cleanup func(pid int)
+}
+
+// CommandSpec is a command in process JSON. It is either a list of a
+// command and arguments which runs after the previous command, or a step
+// object like {"name": "test", "command": ["make", "test"], "needs": ["build"]}.
+type CommandSpec struct {
+	Name    string   `json:"name,omitempty"`
+	Command []string `json:"command"`
+	Needs   []string `json:"needs,omitempty"`
+
+	sequence bool
+}
+
+func (c CommandSpec) MarshalJSON() ([]byte, error) {
+	if c.sequence {
+		return json.Marshal(c.Command)
+	}
+	type step CommandSpec
+	return json.Marshal(step(c))
+}
+
+func (c *CommandSpec) UnmarshalJSON(b []byte) error {
+	var l []string
+	if err := json.Unmarshal(b, &l); err == nil {
+		*c = CommandSpec{Command: l, sequence: true}
+		return nil
+	}
+	type step CommandSpec
+	var s step
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("command must be a list or a step object: %s", b)
+	}
+	*c = CommandSpec(s)
+	return nil
+}
+
+func (c *CommandSpec) command() *Command {
+	return &Command{
+		Name:     c.Command[0],
+		Args:     c.Command[1:],
+		Step:     c.Name,
+		Needs:    c.Needs,
+		Sequence: c.sequence,
+	}
+}
+
+func (c *Command) spec() CommandSpec {
+	return CommandSpec{
+		Name:     c.Step,
+		Command:  append([]string{c.Name}, c.Args...),
+		Needs:    c.Needs,
+		sequence: c.Sequence,
+	}
 }
@@ -0,0 +1,169 @@
+package gj
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var (
+	ErrIdentityNotAllowed = errors.New("identity not allowed")
+)
+
+// Identities is the allowlist of users and groups which processes may run
+// as. Processes without a user or group run as the server and are not
+// checked.
+type Identities struct {
+	users  map[uint32]bool
+	groups map[uint32]bool
+}
+
+// NewIdentities resolves names or numeric IDs of allowed users and groups
+func NewIdentities(users, groups []string) (*Identities, error) {
+	ids := &Identities{users: map[uint32]bool{}, groups: map[uint32]bool{}}
+	for _, name := range users {
+		u, err := lookupUser(name)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		ids.users[uint32(uid)] = true
+	}
+	for _, name := range groups {
+		gid, err := lookupGroup(name)
+		if err != nil {
+			return nil, err
+		}
+		ids.groups[gid] = true
+	}
+	return ids, nil
+}
+
+// check returns ErrIdentityNotAllowed unless cred is allowed. The user u
+// must be in the allowlist even if it is the user of the server. A group is
+// allowed when it is in the allowlist or u is a member of it. The group of
+// the server is allowed only without u.
+func (ids *Identities) check(cred *syscall.Credential, u *user.User) error {
+	if u != nil && (ids == nil || !ids.users[cred.Uid]) {
+		return fmt.Errorf("%s: uid %d", ErrIdentityNotAllowed, cred.Uid)
+	}
+	if ids != nil && ids.groups[cred.Gid] {
+		return nil
+	}
+	if u == nil {
+		if cred.Gid == uint32(os.Getgid()) {
+			return nil
+		}
+		return fmt.Errorf("%s: gid %d", ErrIdentityNotAllowed, cred.Gid)
+	}
+	if u.Gid == strconv.FormatUint(uint64(cred.Gid), 10) {
+		return nil
+	}
+	for _, g := range cred.Groups {
+		if g == cred.Gid {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: gid %d", ErrIdentityNotAllowed, cred.Gid)
+}
+
+// lookupUser finds a user by name, or by ID when name is numeric
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, perr := strconv.ParseUint(name, 10, 32); perr == nil {
+		if u, err = user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown user %s: %s", name, err)
+}
+
+// lookupGroup returns the ID of a group given by name or numeric ID.
+// A numeric ID does not need to exist in the group database.
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %s: %s", name, err)
+	}
+	gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), nil
+}
+
+// credential resolves the user and group which commands run as. It returns
+// nil when neither is set. The group defaults to the primary group of the
+// user, and supplementary groups are those of the user, or those of the
+// server without the user.
+func credential(name, group string) (*syscall.Credential, *user.User, error) {
+	if name == "" && group == "" {
+		return nil, nil, nil
+	}
+	cred := &syscall.Credential{
+		Uid:         uint32(os.Getuid()),
+		Gid:         uint32(os.Getgid()),
+		NoSetGroups: name == "",
+	}
+	var u *user.User
+	if name != "" {
+		var err error
+		if u, err = lookupUser(name); err != nil {
+			return nil, nil, err
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get groups of %s: %s", name, err)
+		}
+		for _, s := range gids {
+			if g, err := strconv.ParseUint(s, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(g))
+			}
+		}
+	}
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err != nil {
+			return nil, nil, err
+		}
+		cred.Gid = gid
+	}
+	return cred, u, nil
+}
+
+// Allowed returns an error if commands of a process can not run as name
+// and group
+func (r *Registry) Allowed(name, group string) error {
+	cred, u, err := credential(name, group)
+	if err != nil || cred == nil {
+		return err
+	}
+	return r.identities.check(cred, u)
+}
+
+// credential resolves and checks the identity of the process. The
+// credential is nil when commands run as the server. It must be called
+// without j.m held.
+func (j *Process) credential() (*syscall.Credential, *user.User, error) {
+	cred, u, err := credential(j.User, j.Group)
+	if err != nil || cred == nil {
+		return nil, nil, err
+	}
+	if err := j.identities.check(cred, u); err != nil {
+		return nil, nil, err
+	}
+	if cred.Uid == uint32(os.Getuid()) && cred.Gid == uint32(os.Getgid()) {
+		// nothing changes, and setgroups needs root
+		return nil, u, nil
+	}
+	return cred, u, nil
+}
@@ -0,0 +1,53 @@
+package gj
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestIdentitiesCheck(t *testing.T) {
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	ids := &Identities{users: map[uint32]bool{1000: true}, groups: map[uint32]bool{50: true}}
+	allowed := &user.User{Uid: "1000", Gid: "100"}
+	server := &user.User{Uid: strconv.Itoa(os.Getuid()), Gid: strconv.Itoa(os.Getgid())}
+	for _, c := range []struct {
+		name    string
+		ids     *Identities
+		cred    *syscall.Credential
+		u       *user.User
+		allowed bool
+	}{
+		{"group of server", ids, &syscall.Credential{Uid: uid, Gid: gid}, nil, true},
+		{"allowed group", ids, &syscall.Credential{Uid: uid, Gid: 50}, nil, true},
+		{"other group", ids, &syscall.Credential{Uid: uid, Gid: 51}, nil, false},
+		{"allowed user", ids, &syscall.Credential{Uid: 1000, Gid: 100}, allowed, true},
+		{"group of user", ids, &syscall.Credential{Uid: 1000, Gid: 60, Groups: []uint32{60}}, allowed, true},
+		{"allowed user and group", ids, &syscall.Credential{Uid: 1000, Gid: 50}, allowed, true},
+		{"group of other", ids, &syscall.Credential{Uid: 1000, Gid: 61}, allowed, false},
+		{"user of server", ids, &syscall.Credential{Uid: uid, Gid: gid}, server, false},
+		{"other user", ids, &syscall.Credential{Uid: 1001, Gid: 100}, &user.User{Uid: "1001", Gid: "100"}, false},
+		{"no allowlist", nil, &syscall.Credential{Uid: 1000, Gid: 100}, allowed, false},
+	} {
+		err := c.ids.check(c.cred, c.u)
+		if (err == nil) != c.allowed {
+			t.Errorf("%s: got=%v, expected allowed=%v", c.name, err, c.allowed)
+		}
+	}
+}
+
+func TestCredentialGroupOnly(t *testing.T) {
+	cred, u, err := credential("", "")
+	if cred != nil || u != nil || err != nil {
+		t.Fatalf("credential without identity: got=%v %v %v", cred, u, err)
+	}
+	cred, u, err = credential("", "12345")
+	if err != nil {
+		t.Fatalf("failed to resolve group: %s", err)
+	}
+	if u != nil || cred.Uid != uint32(os.Getuid()) || cred.Gid != 12345 || !cred.NoSetGroups {
+		t.Errorf("credential mismatch: got=%+v", cred)
+	}
+}
@@ -0,0 +1,159 @@
+package gj
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/execute"
+)
+
+// stepName returns the name of command i for messages
+func stepName(cmds []*Command, i int) string {
+	if cmds[i].Step != "" {
+		return cmds[i].Step
+	}
+	return strconv.Itoa(i)
+}
+
+// dependencies returns indexes of commands which each command needs.
+// It fails on duplicated names, unknown steps and cycles.
+func dependencies(cmds []*Command) ([][]int, error) {
+	index := map[string]int{}
+	for i, c := range cmds {
+		if c.Step == "" {
+			continue
+		}
+		if _, ok := index[c.Step]; ok {
+			return nil, fmt.Errorf("duplicated step name: %s", c.Step)
+		}
+		index[c.Step] = i
+	}
+	deps := make([][]int, len(cmds))
+	for i, c := range cmds {
+		if c.Sequence {
+			if i > 0 {
+				deps[i] = []int{i - 1}
+			}
+			continue
+		}
+		for _, n := range c.Needs {
+			d, ok := index[n]
+			if !ok {
+				return nil, fmt.Errorf("step %s needs unknown step %s", stepName(cmds, i), n)
+			}
+			deps[i] = append(deps[i], d)
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(cmds))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch marks[i] {
+		case visiting:
+			return fmt.Errorf("step %s depends on itself", stepName(cmds, i))
+		case visited:
+			return nil
+		}
+		marks[i] = visiting
+		for _, d := range deps[i] {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		marks[i] = visited
+		return nil
+	}
+	for i := range cmds {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
+
+type stepResult struct {
+	i   int
+	err error
+}
+
+// runSteps runs the commands of r after the commands they need. Up to
+// Parallelism commands run at once, and commands which need a failed
+// command are skipped. It returns the first error of the commands.
+func (j *Process) runSteps(r *Run, deps [][]int, logger *execute.ProcessLogWriter) error {
+	results := make(chan stepResult)
+	running := 0
+	var firstErr error
+	for {
+		j.m.Lock()
+		for changed := true; changed; {
+			changed = false
+			for i, step := range r.Steps {
+				if step.State != StepPending {
+					continue
+				}
+				ready := true
+				for _, d := range deps[i] {
+					switch r.Steps[d].State {
+					case StepSucceeded:
+					case StepFailed, StepSkipped:
+						step.State = StepSkipped
+						changed = true
+					default:
+						ready = false
+					}
+				}
+				if step.State == StepSkipped || !ready || r.stopped {
+					continue
+				}
+				if j.Parallelism > 0 && running >= j.Parallelism {
+					continue
+				}
+				step.State = StepRunning
+				running++
+				go func(i int) {
+					results <- stepResult{i, j.runStep(r, i, logger)}
+				}(i)
+			}
+		}
+		if running == 0 {
+			for _, step := range r.Steps {
+				if step.State == StepPending {
+					step.State = StepSkipped
+				}
+			}
+			j.changed()
+			j.m.Unlock()
+			return firstErr
+		}
+		j.changed()
+		j.m.Unlock()
+		res := <-results
+		running--
+		if res.err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("step %s: %s", stepName(j.Commands, res.i), res.err)
+		}
+	}
+}
+
+// runStep runs command i of r until it exits
+func (j *Process) runStep(r *Run, i int, logger *execute.ProcessLogWriter) error {
+	p, err := j.startCommand(r, i, j.Commands[i], logger)
+	if err != nil {
+		j.finishCommand(r, i, nil, err)
+		return err
+	}
+	if j.StepTimeout > 0 {
+		t := time.AfterFunc(j.StepTimeout, func() {
+			j.timeout(r, i, fmt.Sprintf("step %s timed out after %s", stepName(j.Commands, i), j.StepTimeout))
+		})
+		defer t.Stop()
+	}
+	err = p.Wait()
+	j.finishCommand(r, i, p, err)
+	return err
+}
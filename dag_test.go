@@ -0,0 +1,79 @@
+package gj
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDependencies(t *testing.T) {
+	step := func(name string, needs ...string) *Command {
+		return &Command{Name: "true", Step: name, Needs: needs}
+	}
+	for _, c := range []struct {
+		name     string
+		cmds     []*Command
+		expected [][]int
+		err      string
+	}{
+		{"sequence", []*Command{{Name: "a", Sequence: true}, {Name: "b", Sequence: true}}, [][]int{nil, {0}}, ""},
+		{"graph", []*Command{step("build"), step("test", "build"), step("lint", "build"), step("deploy", "test", "lint")},
+			[][]int{nil, {0}, {0}, {1, 2}}, ""},
+		{"unknown", []*Command{step("test", "build")}, nil, "needs unknown step build"},
+		{"duplicated", []*Command{step("a"), step("a")}, nil, "duplicated step name: a"},
+		{"self", []*Command{step("a", "a")}, nil, "depends on itself"},
+		{"cycle", []*Command{step("a", "c"), step("b", "a"), step("c", "b")}, nil, "depends on itself"},
+	} {
+		deps, err := dependencies(c.cmds)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error mismatch: got=%v, expected=%s", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to resolve: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(deps, c.expected) {
+			t.Errorf("%s: dependencies mismatch: got=%v, expected=%v", c.name, deps, c.expected)
+		}
+	}
+}
+
+func TestRunStepsSkip(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		commands []CommandSpec
+		states   []StepState
+	}{
+		{"needs failed", []CommandSpec{
+			{Name: "a", Command: []string{"false"}},
+			{Name: "b", Command: []string{"true"}, Needs: []string{"a"}},
+			{Name: "c", Command: []string{"true"}, Needs: []string{"b"}},
+			{Name: "d", Command: []string{"true"}},
+		}, []StepState{StepFailed, StepSkipped, StepSkipped, StepSucceeded}},
+		{"needs one of failed", []CommandSpec{
+			{Name: "a", Command: []string{"true"}},
+			{Name: "b", Command: []string{"false"}},
+			{Name: "c", Command: []string{"true"}, Needs: []string{"a", "b"}},
+			{Name: "d", Command: []string{"true"}, Needs: []string{"a"}},
+		}, []StepState{StepSucceeded, StepFailed, StepSkipped, StepSucceeded}},
+		{"sequence", []CommandSpec{
+			{Command: []string{"false"}, sequence: true},
+			{Command: []string{"true"}, sequence: true},
+		}, []StepState{StepFailed, StepSkipped}},
+	} {
+		r := runProcess(t, &ProcessViewModel{Commands: c.commands})
+		if r.State != StateFailed {
+			t.Errorf("%s: state mismatch: got=%s, expected=%s", c.name, r.State, StateFailed)
+		}
+		states := []StepState{}
+		for _, s := range r.Steps {
+			states = append(states, s.State)
+		}
+		if !reflect.DeepEqual(states, c.states) {
+			t.Errorf("%s: steps mismatch: got=%v, expected=%v", c.name, states, c.states)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package gj
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yoru9zine/gj/pkg/dotenv"
+)
+
+// Env is environment variables written as an object in JSON. A list of
+// KEY=VALUE is also accepted.
+type Env map[string]string
+
+func (e *Env) UnmarshalJSON(b []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err == nil {
+		*e = m
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return fmt.Errorf("env must be an object or a list of KEY=VALUE: %s", b)
+	}
+	*e = Env{}
+	for _, kv := range l {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid env: %s", kv)
+		}
+		(*e)[kv[:i]] = kv[i+1:]
+	}
+	return nil
+}
+
+// environ is an environment being built for a run
+type environ map[string]string
+
+func (e environ) expand(s string) string {
+	return os.Expand(s, func(k string) string {
+		if k == "$" {
+			// $$ is a literal $
+			return "$"
+		}
+		return e[k]
+	})
+}
+
+func (e environ) list() []string {
+	l := make([]string, 0, len(e))
+	for k, v := range e {
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// resolveEnv returns the working directory and environment of commands.
+// The server environment unless InheritEnv is false, EnvFiles and Env
+// are merged in this order. ${VAR} in Dir, env files and Env values is
+// expanded with variables defined before them. HOME, USER and LOGNAME
+// of the server are replaced with those of u if it is not nil.
+func (j *Process) resolveEnv(u *user.User) (string, []string, error) {
+	env := environ{}
+	if j.InheritEnv {
+		for _, kv := range os.Environ() {
+			if i := strings.Index(kv, "="); i > 0 {
+				env[kv[:i]] = kv[i+1:]
+			}
+		}
+	}
+	if u != nil {
+		env["HOME"] = u.HomeDir
+		env["USER"] = u.Username
+		env["LOGNAME"] = u.Username
+	}
+	dir := env.expand(j.Dir)
+	for _, path := range j.EnvFiles {
+		path = env.expand(path)
+		if !filepath.IsAbs(path) && dir != "" {
+			path = filepath.Join(dir, path)
+		}
+		if err := env.load(path); err != nil {
+			return "", nil, err
+		}
+	}
+	expanded := map[string]string{}
+	for k, v := range j.Env {
+		expanded[k] = env.expand(v)
+	}
+	for k, v := range expanded {
+		env[k] = v
+	}
+	return dir, env.list(), nil
+}
+
+func (e environ) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open env file: %s", err)
+	}
+	defer f.Close()
+	vars, err := dotenv.Parse(f, func(s string, vars []dotenv.Var) string {
+		for _, v := range vars {
+			e[v.Key] = v.Value
+		}
+		return e.expand(s)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to parse env file %s: %s", path, err)
+	}
+	for _, v := range vars {
+		e[v.Key] = v.Value
+	}
+	return nil
+}
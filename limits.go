@@ -0,0 +1,154 @@
+package gj
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/cgroup"
+	"github.com/yoru9zine/gj/pkg/execute"
+	"golang.org/x/sys/unix"
+)
+
+// Limits are resource limits of each run of a process. When the server has
+// cgroup v2, a run executes in its own cgroup which limits Memory, CPU cores
+// and Pids of the whole run. Otherwise Memory falls back to RLIMIT_AS, the
+// virtual address space of each command, and CPU and Pids are refused as
+// RLIMIT_NPROC would count all processes of the user.
+type Limits struct {
+	Memory    ByteSize `json:"memory,omitempty"`
+	CPU       float64  `json:"cpu,omitempty"`
+	CPUTime   Duration `json:"cpu_time,omitempty"`
+	Pids      int      `json:"pids,omitempty"`
+	OpenFiles int      `json:"open_files,omitempty"`
+}
+
+func (l *Limits) validate() error {
+	if l.Memory < 0 || l.CPU < 0 || l.CPUTime < 0 || l.Pids < 0 || l.OpenFiles < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+func (l *Limits) empty() bool {
+	return *l == Limits{}
+}
+
+// rlimits returns the limits applied to each command. Memory is included
+// only without cgroup.
+func (l *Limits) rlimits(cgroup bool) []execute.Rlimit {
+	limits := []execute.Rlimit{}
+	add := func(resource int, v uint64) {
+		limits = append(limits, execute.Rlimit{Resource: resource, Cur: v, Max: v})
+	}
+	if l.OpenFiles > 0 {
+		add(unix.RLIMIT_NOFILE, uint64(l.OpenFiles))
+	}
+	if l.CPUTime > 0 {
+		seconds := (time.Duration(l.CPUTime) + time.Second - 1) / time.Second
+		add(unix.RLIMIT_CPU, uint64(seconds))
+	}
+	if !cgroup && l.Memory > 0 {
+		add(unix.RLIMIT_AS, uint64(l.Memory))
+	}
+	return limits
+}
+
+// checkCgroup returns an error when l needs cgroup which the server does
+// not have
+func (l *Limits) checkCgroup(cgroup bool) error {
+	if !cgroup && l.CPU > 0 {
+		return fmt.Errorf("cpu limit needs cgroup v2, which the server does not use")
+	}
+	if !cgroup && l.Pids > 0 {
+		return fmt.Errorf("pids limit needs cgroup v2, which the server does not use")
+	}
+	return nil
+}
+
+// enforced returns how each limit is applied, by cgroup or rlimit
+func (l *Limits) enforced(cgroup bool) map[string]string {
+	m := map[string]string{}
+	by := "rlimit"
+	if cgroup {
+		by = "cgroup"
+	}
+	if l.Memory > 0 {
+		m["memory"] = by
+	}
+	if cgroup && l.Pids > 0 {
+		m["pids"] = by
+	}
+	if cgroup && l.CPU > 0 {
+		m["cpu"] = by
+	}
+	if l.CPUTime > 0 {
+		m["cpu_time"] = "rlimit"
+	}
+	if l.OpenFiles > 0 {
+		m["open_files"] = "rlimit"
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// CheckLimits returns an error when l cannot be enforced by the server
+func (r *Registry) CheckLimits(l *Limits) error {
+	return l.checkCgroup(r.cgroups != nil)
+}
+
+// setupCgroup creates the cgroup of r when the process has limits and the
+// server has cgroup v2
+func (j *Process) setupCgroup(r *Run) (*cgroup.Cgroup, error) {
+	if j.cgroups == nil || j.Limits.empty() {
+		return nil, nil
+	}
+	cg, err := j.cgroups.Create(j.ID + "-" + strconv.Itoa(r.Number))
+	if err != nil {
+		return nil, err
+	}
+	set := func(err error) error {
+		if err != nil {
+			cg.Remove()
+			return fmt.Errorf("failed to set cgroup limits: %s", err)
+		}
+		return nil
+	}
+	if j.Limits.Memory > 0 {
+		if err := set(cg.SetMemory(int64(j.Limits.Memory))); err != nil {
+			return nil, err
+		}
+	}
+	if j.Limits.CPU > 0 {
+		if err := set(cg.SetCPU(j.Limits.CPU)); err != nil {
+			return nil, err
+		}
+	}
+	if j.Limits.Pids > 0 {
+		if err := set(cg.SetPids(j.Limits.Pids)); err != nil {
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// checkOOM marks step i as killed by the OOM killer when the cgroup of r
+// has new OOM kills. It must be called with j.m held.
+func (j *Process) checkOOM(r *Run, i int) {
+	if r.cgroup == nil || r.Steps[i].Signal == "" {
+		return
+	}
+	n, err := r.cgroup.OOMKills()
+	if err != nil {
+		log.Printf("failed to read oom events of process %s: %s", j.ID, err)
+		return
+	}
+	if n > r.oomKills {
+		r.oomKills = n
+		r.oomKilled = true
+		r.Steps[i].OOMKilled = true
+	}
+}
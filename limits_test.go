@@ -0,0 +1,35 @@
+package gj
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLimitsFallback(t *testing.T) {
+	l := &Limits{Memory: 1 << 20, CPU: 1, Pids: 10, OpenFiles: 64}
+	for _, c := range []struct {
+		cgroup    bool
+		resources []int
+		enforced  map[string]string
+		refused   bool
+	}{
+		{true, []int{unix.RLIMIT_NOFILE}, map[string]string{"memory": "cgroup", "cpu": "cgroup", "pids": "cgroup", "open_files": "rlimit"}, false},
+		{false, []int{unix.RLIMIT_NOFILE, unix.RLIMIT_AS}, map[string]string{"memory": "rlimit", "open_files": "rlimit"}, true},
+	} {
+		resources := []int{}
+		for _, rl := range l.rlimits(c.cgroup) {
+			resources = append(resources, rl.Resource)
+		}
+		if !reflect.DeepEqual(resources, c.resources) {
+			t.Errorf("cgroup=%v: rlimits mismatch: got=%v, expected=%v", c.cgroup, resources, c.resources)
+		}
+		if e := l.enforced(c.cgroup); !reflect.DeepEqual(e, c.enforced) {
+			t.Errorf("cgroup=%v: enforced mismatch: got=%v, expected=%v", c.cgroup, e, c.enforced)
+		}
+		if err := l.checkCgroup(c.cgroup); (err != nil) != c.refused {
+			t.Errorf("cgroup=%v: refused mismatch: got=%v, expected=%v", c.cgroup, err, c.refused)
+		}
+	}
+}
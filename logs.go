@@ -0,0 +1,186 @@
+package gj
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/execute"
+)
+
+// LogConfig rotates and caps the log of each run
+type LogConfig struct {
+	// SegmentSize starts a new segment when the current one would exceed it
+	SegmentSize ByteSize `json:"segment_size,omitempty"`
+	// MaxSize drops output after the log of a run reaches it
+	MaxSize ByteSize `json:"max_size,omitempty"`
+	// Compress gzips segments after they are closed
+	Compress bool `json:"compress,omitempty"`
+	// Lines records output line by line, splitting lines longer than
+	// MaxLineLength
+	Lines         bool     `json:"lines,omitempty"`
+	MaxLineLength ByteSize `json:"max_line_length,omitempty"`
+}
+
+func (c *LogConfig) validate() error {
+	if c.SegmentSize < 0 || c.MaxSize < 0 || c.MaxLineLength < 0 {
+		return fmt.Errorf("log sizes must not be negative")
+	}
+	if c.MaxLineLength > 0 && !c.Lines {
+		return fmt.Errorf("max_line_length requires lines")
+	}
+	return nil
+}
+
+func (c *LogConfig) lineMode() *execute.LineMode {
+	if !c.Lines {
+		return nil
+	}
+	return &execute.LineMode{MaxLength: int(c.MaxLineLength)}
+}
+
+func (c *LogConfig) limits() execute.LogLimits {
+	return execute.LogLimits{
+		SegmentSize: int64(c.SegmentSize),
+		MaxSize:     int64(c.MaxSize),
+		Compress:    c.Compress,
+	}
+}
+
+// truncatedMessage is written in place of output dropped by LogConfig.MaxSize
+const truncatedMessage = "[gj: output truncated by the log size limit]\n"
+
+// setupErrorMessage is written to stderr of a run which failed before its
+// commands started
+const setupErrorMessage = "[gj: failed to set up the run: %s]\n"
+
+// LogOption selects and formats output of a log
+type LogOption struct {
+	// Timestamps prefixes each line with the time of the record where it starts
+	Timestamps bool
+	// Since and Until select records written in the range. Zero is unbounded.
+	// Records of old logs without time are not selected if either is set.
+	Since time.Time
+	Until time.Time
+}
+
+// Query returns o as query parameters of the log API
+func (o *LogOption) Query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	if o.Timestamps {
+		q.Set("timestamps", "true")
+	}
+	if !o.Since.IsZero() {
+		q.Set("since", o.Since.Format(time.RFC3339Nano))
+	}
+	if !o.Until.IsZero() {
+		q.Set("until", o.Until.Format(time.RFC3339Nano))
+	}
+	return q
+}
+
+// ParseLogOption parses query parameters made by Query. since and until
+// may also be ages like "10m" or "2d" before now.
+func ParseLogOption(q url.Values, now time.Time) (*LogOption, error) {
+	o := &LogOption{}
+	var err error
+	if s := q.Get("timestamps"); s != "" {
+		if o.Timestamps, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("invalid timestamps: %s", s)
+		}
+	}
+	if s := q.Get("since"); s != "" {
+		if o.Since, err = ParseLogTime(s, now); err != nil {
+			return nil, err
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if o.Until, err = ParseLogTime(s, now); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// ParseLogTime parses RFC 3339 time, or age like "10m" or "2d" before now
+func ParseLogTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	d, err := ParseAge(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", s)
+	}
+	return now.Add(-d), nil
+}
+
+// logPrinter writes stdout and stderr of log records selected by opt
+type logPrinter struct {
+	w   io.Writer
+	opt *LogOption
+	// midline is true when the last output did not end with a newline
+	midline bool
+}
+
+func newLogPrinter(w io.Writer, opt *LogOption) *logPrinter {
+	if opt == nil {
+		opt = &LogOption{}
+	}
+	return &logPrinter{w: w, opt: opt}
+}
+
+func (p *logPrinter) selected(rec *execute.LogRecord) bool {
+	if rec.Type == "stdin" {
+		return false
+	}
+	if p.opt.Since.IsZero() && p.opt.Until.IsZero() {
+		return true
+	}
+	if rec.Time.IsZero() {
+		return false
+	}
+	return !rec.Time.Before(p.opt.Since) && (p.opt.Until.IsZero() || !rec.Time.After(p.opt.Until))
+}
+
+func (p *logPrinter) print(rec *execute.LogRecord) error {
+	if !p.selected(rec) {
+		return nil
+	}
+	data := rec.Data
+	if rec.Truncated {
+		data = []byte(truncatedMessage)
+		if p.midline {
+			if _, err := p.w.Write([]byte("\n")); err != nil {
+				return err
+			}
+			p.midline = false
+		}
+	}
+	if p.opt.Timestamps && !rec.Time.IsZero() {
+		prefix := []byte(rec.Time.Format(time.RFC3339Nano) + " ")
+		var buf bytes.Buffer
+		for len(data) > 0 {
+			if !p.midline {
+				buf.Write(prefix)
+			}
+			line := data
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line = data[:i+1]
+			}
+			buf.Write(line)
+			data = data[len(line):]
+			p.midline = line[len(line)-1] != '\n'
+		}
+		data = buf.Bytes()
+	} else if len(data) > 0 {
+		p.midline = data[len(data)-1] != '\n'
+	}
+	_, err := p.w.Write(data)
+	return err
+}
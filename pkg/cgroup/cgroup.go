@@ -0,0 +1,185 @@
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnavailable is returned when no writable cgroup v2 hierarchy is found
+	ErrUnavailable = errors.New("cgroup v2 is not available")
+)
+
+const mountPoint = "/sys/fs/cgroup"
+
+// controllers are enabled for job cgroups when available
+var controllers = []string{"cpu", "memory", "pids"}
+
+// Manager creates cgroups under Dir
+type Manager struct {
+	Dir string
+}
+
+// Setup prepares dir to hold cgroups of jobs. When dir is the cgroup of
+// the server, such as one delegated by systemd, the server moves into its
+// "server" child because a cgroup with processes cannot enable controllers
+// for children.
+func Setup(dir string) (*Manager, error) {
+	if dir == "" {
+		return nil, ErrUnavailable
+	}
+	dir = filepath.Clean(dir)
+	if self, err := selfCgroup(); err == nil && filepath.Join(mountPoint, self) == dir {
+		if err := moveSelf(filepath.Join(dir, "server")); err != nil {
+			return nil, err
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return nil, ErrUnavailable
+	}
+	available := strings.Fields(string(b))
+	for _, c := range controllers {
+		if !contains(available, c) {
+			continue
+		}
+		if err := write(dir, "cgroup.subtree_control", "+"+c); err != nil {
+			return nil, fmt.Errorf("failed to enable %s controller: %s", c, err)
+		}
+	}
+	return &Manager{Dir: dir}, nil
+}
+
+// selfCgroup returns the cgroup v2 path of the current process
+func selfCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", ErrUnavailable
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), "0::") {
+			if _, err := os.Stat(filepath.Join(mountPoint, "cgroup.controllers")); err != nil {
+				// hybrid hierarchy
+				return "", ErrUnavailable
+			}
+			return strings.TrimPrefix(sc.Text(), "0::"), nil
+		}
+	}
+	return "", ErrUnavailable
+}
+
+func moveSelf(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return ErrUnavailable
+	}
+	if err := write(dir, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return fmt.Errorf("failed to move server to %s: %s", dir, err)
+	}
+	return nil
+}
+
+// Create makes a cgroup named name
+func (m *Manager) Create(name string) (*Cgroup, error) {
+	dir := filepath.Join(m.Dir, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %s", err)
+	}
+	return &Cgroup{Dir: dir}, nil
+}
+
+// Cgroup is a cgroup of a job
+type Cgroup struct {
+	Dir string
+}
+
+// SetMemory limits memory usage in bytes. Swap is not allowed.
+func (c *Cgroup) SetMemory(bytes int64) error {
+	if err := write(c.Dir, "memory.max", strconv.FormatInt(bytes, 10)); err != nil {
+		return err
+	}
+	// swap may be disabled on the host
+	write(c.Dir, "memory.swap.max", "0")
+	return nil
+}
+
+// SetCPU limits cpu usage to cores
+func (c *Cgroup) SetCPU(cores float64) error {
+	const period = 100000
+	return write(c.Dir, "cpu.max", fmt.Sprintf("%d %d", int64(cores*period), period))
+}
+
+// SetPids limits the number of processes
+func (c *Cgroup) SetPids(n int) error {
+	return write(c.Dir, "pids.max", strconv.Itoa(n))
+}
+
+// OOMKills returns the number of processes killed by the OOM killer
+func (c *Cgroup) OOMKills() (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(c.Dir, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	return parseEvent(string(b), "oom_kill"), nil
+}
+
+// Procs returns IDs of processes in the cgroup
+func (c *Cgroup) Procs() ([]int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(c.Dir, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	pids := []int{}
+	for _, f := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+func parseEvent(events, key string) int {
+	for _, line := range strings.Split(events, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == key {
+			n, _ := strconv.Atoi(f[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// Remove kills processes left in the cgroup and removes it
+func (c *Cgroup) Remove() error {
+	// cgroup.kill is available since Linux 5.14
+	write(c.Dir, "cgroup.kill", "1")
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(c.Dir); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup: %s", err)
+}
+
+func write(dir, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
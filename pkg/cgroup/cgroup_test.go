@@ -0,0 +1,49 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseEvent(t *testing.T) {
+	events := "low 0\nhigh 0\nmax 3\noom 2\noom_kill 1\n"
+	if n := parseEvent(events, "oom_kill"); n != 1 {
+		t.Fatalf("oom_kill mismatch: got=%d expected=1", n)
+	}
+	if n := parseEvent(events, "oom_group_kill"); n != 0 {
+		t.Fatalf("missing event mismatch: got=%d expected=0", n)
+	}
+}
+
+func TestCgroupFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{Dir: dir}
+	c, err := m.Create("job")
+	if err != nil {
+		t.Fatalf("failed to create cgroup: %s", err)
+	}
+	if err := c.SetCPU(1.5); err != nil {
+		t.Fatalf("failed to set cpu: %s", err)
+	}
+	if err := c.SetMemory(64 << 20); err != nil {
+		t.Fatalf("failed to set memory: %s", err)
+	}
+	for file, expected := range map[string]string{
+		"cpu.max":    "150000 100000",
+		"memory.max": "67108864",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(c.Dir, file))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", file, err)
+		}
+		if string(b) != expected {
+			t.Fatalf("%s mismatch: got=%s expected=%s", file, b, expected)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package dotenv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Var is a variable defined in a dotenv file
+type Var struct {
+	Key   string
+	Value string
+}
+
+// Parse reads KEY=VALUE lines in dotenv format from r. Blank lines, lines
+// starting with # and an "export " prefix are ignored. Values may be quoted
+// with ' or ". Values which are not single-quoted are passed to expand with
+// the variables defined before them.
+func Parse(r io.Reader, expand func(s string, vars []Var) string) ([]Var, error) {
+	vars := []Var{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: missing '='", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: invalid key %q", n, key)
+		}
+		value, literal, err := parseValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		if !literal && expand != nil {
+			value = expand(value, vars)
+		}
+		vars = append(vars, Var{Key: key, Value: value})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// parseValue unquotes v. literal is true for a single-quoted value.
+func parseValue(v string) (value string, literal bool, err error) {
+	if v == "" {
+		return "", false, nil
+	}
+	switch q := v[0]; q {
+	case '\'':
+		end := strings.IndexByte(v[1:], '\'')
+		if end < 0 {
+			return "", false, fmt.Errorf("unterminated quote")
+		}
+		return v[1 : end+1], true, nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(v); i++ {
+			switch c := v[i]; c {
+			case '"':
+				return b.String(), false, nil
+			case '\\':
+				if i+1 == len(v) {
+					return "", false, fmt.Errorf("unterminated quote")
+				}
+				i++
+				switch v[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(v[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", false, fmt.Errorf("unterminated quote")
+	}
+	// inline comment
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, false, nil
+}
@@ -0,0 +1,53 @@
+package dotenv
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	src := `
+# comment
+A=1
+export B = two words # comment
+C="quoted # not comment\n"
+D='${A} literal'
+E=${A}-${B}
+EMPTY=
+`
+	expand := func(s string, vars []Var) string {
+		return os.Expand(s, func(k string) string {
+			for i := len(vars) - 1; i >= 0; i-- {
+				if vars[i].Key == k {
+					return vars[i].Value
+				}
+			}
+			return ""
+		})
+	}
+	vars, err := Parse(strings.NewReader(src), expand)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	expected := []Var{
+		{"A", "1"},
+		{"B", "two words"},
+		{"C", "quoted # not comment\n"},
+		{"D", "${A} literal"},
+		{"E", "1-two words"},
+		{"EMPTY", ""},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Fatalf("vars mismatch:\ngot=%q\nexpected=%q", vars, expected)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, src := range []string{"NOVALUE", "=1", "A=\"open", "A='open", "A B=1"} {
+		if _, err := Parse(strings.NewReader(src), nil); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package execute
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -12,21 +11,52 @@ import (
 	"syscall"
 
 	"github.com/kr/pty"
+	"golang.org/x/sys/unix"
 )
 
 var (
-	// ErrProcessNotStarted is returned when Wait calls before Start
+	// ErrProcessNotStarted is returned when Wait or Signal calls before Start
 	ErrProcessNotStarted = errors.New("process not started")
+	// ErrNoPTY is returned when Resize calls for a process without pty
+	ErrNoPTY = errors.New("process has no pty")
 )
 
 // A ProcessOption is used to configure a Process
 type ProcessOption struct {
-	Dir  string
-	Name string
-	Env  []string
+	Dir     string
+	Name    string
+	Env     []string
+	WorkDir string
 
 	LogIO       interface{}
 	AllocatePTY bool
+	// Rows and Cols are the initial window size of the pty.
+	// Zero leaves the default size.
+	Rows uint16
+	Cols uint16
+
+	// LogLimits rotates and caps the log of Dir and Name
+	LogLimits LogLimits
+	// Logger is used instead of opening the log of Dir and Name.
+	// It is shared between processes and is not closed by Wait.
+	Logger *ProcessLogWriter
+	// Step is the index of the command in its run recorded in the log
+	Step int
+	// Lines splits records of the log at the end of lines if set
+	Lines *LineMode
+
+	// Rlimits are applied before the command is executed by re-executing
+	// the program through Init
+	Rlimits []Rlimit
+	// CgroupDir is a cgroup v2 directory which the command starts in
+	CgroupDir string
+	// Credential is the user and groups which the command runs as
+	Credential *syscall.Credential
+	// Cleanup is called with the process ID after the command exits and
+	// before it is reaped, so that its process group ID is not reused yet.
+	// It should terminate processes left by the command, which otherwise
+	// keep the output open and Wait blocks until they exit.
+	Cleanup func(pid int)
 }
 
 func (o *ProcessOption) logFile() string {
@@ -52,41 +82,70 @@ func (o *ProcessOption) readCloser() (io.ReadCloser, error) {
 	if o.LogIO != nil {
 		return multiIO{[]interface{}{o.LogIO}}, nil
 	}
-	f, err := os.Open(o.logFile())
+	f, err := o.openSegment(0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open `%s`: %s", o.logFile(), err)
 	}
-	return f, nil
+	return &segmentReader{opt: o, cur: f}, nil
 }
 
 // Process represents an external command
 type Process struct {
 	Stdin     io.WriteCloser
 	cmd       *exec.Cmd
-	logWriter *processLogWriter
+	logWriter *ProcessLogWriter
+	ownLog    bool
 	m         sync.Mutex
 	tty       *os.File
 	pty       *os.File
 
 	started bool
+	exited  chan struct{}
 
-	readerChannels map[string]*reader2chan
-	handleFinish   chan struct{}
+	// outputs are stdout and stderr, or the pty, by log type
+	outputs map[string]io.Reader
+	// childPipes are ends of pipes passed to the command, which are closed
+	// once it starts, and pipes are the other ends closed after it exits
+	childPipes     []*os.File
+	pipes          []*os.File
+	pumping        sync.WaitGroup
 	ErrorAtLogging error
+
+	listeners map[chan []byte]struct{}
+	outputEnd bool
+
+	rlimits   []Rlimit
+	cgroupDir string
+	cleanup   func(pid int)
+	step      int
 }
 
 // Start starts process
 func (p *Process) Start() error {
-	for t, c := range p.readerChannels {
-		go c.Start()
-		go p.handleInput(c.Channel, t)
+	if p.cgroupDir != "" {
+		f, err := os.Open(p.cgroupDir)
+		if err != nil {
+			p.release()
+			return fmt.Errorf("failed to open cgroup: %s", err)
+		}
+		defer f.Close()
+		p.cmd.SysProcAttr.UseCgroupFD = true
+		p.cmd.SysProcAttr.CgroupFD = int(f.Fd())
 	}
-	p.handleFinish = make(chan struct{})
-	if p.tty != nil {
-		defer p.tty.Close()
+	if len(p.rlimits) > 0 {
+		withRlimits(p.cmd, p.rlimits)
+	}
+	if err := p.cmd.Start(); err != nil {
+		p.release()
+		return err
+	}
+	closeFiles(p.childPipes)
+	for t, r := range p.outputs {
+		p.pumping.Add(1)
+		go p.pump(r, t)
 	}
 	p.started = true
-	return p.cmd.Start()
+	return nil
 }
 
 // Wait waits process
@@ -94,85 +153,319 @@ func (p *Process) Wait() error {
 	if !p.started {
 		return ErrProcessNotStarted
 	}
+	if p.cleanup != nil || p.tty != nil {
+		if err := waitExit(p.cmd.Process.Pid); err != nil {
+			return fmt.Errorf("failed to wait process: %s", err)
+		}
+	}
+	if p.cleanup != nil {
+		p.cleanup(p.cmd.Process.Pid)
+	}
+	// the terminal is held open until the command exits, since output
+	// written right before its last close may be discarded
+	if p.tty != nil {
+		p.tty.Close()
+	}
+	// output must be logged to the end before the pipes are closed
+	p.pumping.Wait()
 	cmdErr := p.cmd.Wait()
-	for _, c := range p.readerChannels {
-		c.Stop()
-		<-p.handleFinish
+	closeFiles(p.pipes)
+	if p.pty != nil {
+		p.pty.Close()
 	}
-	if err := p.logWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close log: %s", err)
+	close(p.exited)
+	p.m.Lock()
+	p.outputEnd = true
+	for l := range p.listeners {
+		close(l)
+		delete(p.listeners, l)
+	}
+	p.m.Unlock()
+	if p.ownLog {
+		if err := p.logWriter.Close(); err != nil {
+			return fmt.Errorf("failed to close log: %s", err)
+		}
+	} else if err := p.logWriter.Flush(p.step); err != nil {
+		return fmt.Errorf("failed to flush log: %s", err)
 	}
 	return cmdErr
 }
 
-func (p *Process) handleInput(c chan []byte, logType string) {
-	for line := range c {
-		if err := p.logWriter.Write(line, logType); err != nil {
-			p.ErrorAtLogging = err
+// release closes the pipes, the pty and the log owned by a process which
+// failed to start
+func (p *Process) release() {
+	closeFiles(p.childPipes)
+	closeFiles(p.pipes)
+	if p.tty != nil {
+		p.tty.Close()
+	}
+	if p.pty != nil {
+		p.pty.Close()
+	}
+	if p.ownLog {
+		p.logWriter.Close()
+	}
+}
+
+// waitExit blocks until pid exits without reaping it
+func waitExit(pid int) error {
+	var info unix.Siginfo
+	for {
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// Signal sends sig to the process group of the process
+func (p *Process) Signal(sig syscall.Signal) error {
+	if !p.started {
+		return ErrProcessNotStarted
+	}
+	return syscall.Kill(-p.cmd.Process.Pid, sig)
+}
+
+// Pid returns the process ID, which is also the ID of its process group
+func (p *Process) Pid() int {
+	if !p.started {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
+// ProcessState returns the state of the exited process
+func (p *Process) ProcessState() *os.ProcessState {
+	return p.cmd.ProcessState
+}
+
+// CloseStdin closes stdin of the process. For pty it sends EOF character.
+func (p *Process) CloseStdin() error {
+	if p.pty != nil {
+		_, err := p.pty.Write([]byte{4})
+		return err
+	}
+	return p.Stdin.Close()
+}
+
+// Resize changes the window size of the pty
+func (p *Process) Resize(rows, cols uint16) error {
+	if p.pty == nil {
+		return ErrNoPTY
+	}
+	return pty.Setsize(p.pty, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// Exited returns a channel which is closed after the process exits
+func (p *Process) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// Attach returns a channel which receives output of the process written
+// after the call. The channel is closed at the end of output or by detach.
+// Output is dropped for a listener which does not keep up.
+func (p *Process) Attach() (output <-chan []byte, detach func()) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	l := make(chan []byte, 256)
+	if p.outputEnd {
+		close(l)
+		return l, func() {}
+	}
+	if p.listeners == nil {
+		p.listeners = map[chan []byte]struct{}{}
+	}
+	p.listeners[l] = struct{}{}
+	return l, func() {
+		p.m.Lock()
+		defer p.m.Unlock()
+		if _, ok := p.listeners[l]; ok {
+			close(l)
+			delete(p.listeners, l)
+		}
+	}
+}
+
+// broadcast sends a copy of b to listeners
+func (p *Process) broadcast(b []byte) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if len(p.listeners) == 0 {
+		return
+	}
+	c := append([]byte(nil), b...)
+	for l := range p.listeners {
+		select {
+		case l <- c:
+		default:
+		}
+	}
+}
+
+// stdinWriter writes to stdin of the process and logs written data
+type stdinWriter struct {
+	w io.WriteCloser
+	p *Process
+}
+
+func (s *stdinWriter) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	if n > 0 {
+		if err := s.p.logWriter.Write(b[:n], "stdin", s.p.step); err != nil {
+			s.p.m.Lock()
+			if s.p.ErrorAtLogging == nil {
+				s.p.ErrorAtLogging = err
+			}
+			s.p.m.Unlock()
+		}
+	}
+	return n, err
+}
+
+func (s *stdinWriter) Close() error {
+	return s.w.Close()
+}
+
+// pump logs output read from r and sends it to listeners until the end of
+// r. Reads block until output is available, and buffers are reused.
+func (p *Process) pump(r io.Reader, logType string) {
+	defer p.pumping.Done()
+	for {
+		buf := outputBuffers.Get().(*[]byte)
+		n, err := r.Read(*buf)
+		if n > 0 {
+			if lerr := p.logWriter.Write((*buf)[:n], logType, p.step); lerr != nil {
+				p.m.Lock()
+				if p.ErrorAtLogging == nil {
+					p.ErrorAtLogging = lerr
+				}
+				p.m.Unlock()
+			}
+			p.broadcast((*buf)[:n])
+		}
+		outputBuffers.Put(buf)
+		// the end is io.EOF for pipes and EIO for the pty
+		if err != nil {
+			return
 		}
 	}
-	p.handleFinish <- struct{}{}
 }
 
 // NewProcess create and returns new Process
 func NewProcess(opt *ProcessOption, cmds ...string) (*Process, error) {
+	var p *Process
+	var err error
 	if opt.AllocatePTY {
-		return executePTY(opt, cmds...)
+		p, err = executePTY(opt, cmds...)
+	} else {
+		p, err = execute(opt, cmds...)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return execute(opt, cmds...)
+	p.rlimits = opt.Rlimits
+	p.cgroupDir = opt.CgroupDir
+	p.cleanup = opt.Cleanup
+	p.step = opt.Step
+	return p, nil
+}
+
+func (o *ProcessOption) logWriter() (*ProcessLogWriter, bool, error) {
+	if o.Logger != nil {
+		return o.Logger, false, nil
+	}
+	l, err := NewProcessLogWriter(o)
+	if err != nil {
+		return nil, false, err
+	}
+	return l, true, nil
 }
 
 func execute(opt *ProcessOption, cmds ...string) (*Process, error) {
 	cmd := exec.Command(cmds[0], cmds[1:]...)
 	cmd.Env = opt.Env
-	f, err := opt.writeCloser()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open log", err)
+	cmd.Dir = opt.WorkDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: opt.Credential}
+	// pipes are created here instead of by cmd so that they are closed
+	// when the process fails before cmd starts
+	var childPipes, pipes []*os.File
+	ok := false
+	defer func() {
+		if !ok {
+			closeFiles(childPipes)
+			closeFiles(pipes)
+		}
+	}()
+	pipe := func(name string) (*os.File, *os.File, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create pipe for %s: %s", name, err)
+		}
+		return r, w, nil
 	}
-	logwriter, err := newProcessLogWriter(f)
+	stdout, w, err := pipe("STDOUT")
 	if err != nil {
-		return nil, fmt.Errorf(`failed to create logger: %s`, err)
+		return nil, err
 	}
-	stdout, err := cmd.StdoutPipe()
+	cmd.Stdout = w
+	childPipes, pipes = append(childPipes, w), append(pipes, stdout)
+	stderr, w, err := pipe("STDERR")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pipe for STDOUT: %s", err)
+		return nil, err
 	}
-	stderr, err := cmd.StderrPipe()
+	cmd.Stderr = w
+	childPipes, pipes = append(childPipes, w), append(pipes, stderr)
+	r, stdin, err := pipe("STDIN")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pipe for STDERR: %s", err)
+		return nil, err
 	}
-	stdin, err := cmd.StdinPipe()
+	cmd.Stdin = r
+	childPipes, pipes = append(childPipes, r), append(pipes, stdin)
+	logwriter, ownLog, err := opt.logWriter()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pipe for STDIN: %s", err)
+		return nil, err
 	}
-	stdinbuf := &bytes.Buffer{}
 	p := &Process{
-		Stdin:          &multiIO{ioObjects: []interface{}{stdin, stdinbuf}},
-		cmd:            cmd,
-		logWriter:      logwriter,
-		readerChannels: map[string]*reader2chan{},
+		cmd:        cmd,
+		logWriter:  logwriter,
+		ownLog:     ownLog,
+		exited:     make(chan struct{}),
+		outputs:    map[string]io.Reader{"stdout": stdout, "stderr": stderr},
+		childPipes: childPipes,
+		pipes:      pipes,
 	}
-	p.readerChannels["stdout"] = newReader2Chan(stdout)
-	p.readerChannels["stderr"] = newReader2Chan(stderr)
-	p.readerChannels["stdin"] = newReader2Chan(stdinbuf)
-
+	p.Stdin = &stdinWriter{w: stdin, p: p}
+	ok = true
 	return p, nil
 }
 
+// closeFiles closes files ignoring errors of those already closed
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
 func executePTY(opt *ProcessOption, cmds ...string) (*Process, error) {
 	cmd := exec.Command(cmds[0], cmds[1:]...)
 	cmd.Env = opt.Env
-	f, err := opt.writeCloser()
+	cmd.Dir = opt.WorkDir
+	ptmx, tty, err := pty.Open()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open log", err)
+		return nil, fmt.Errorf("failed to create pty: %s", err)
 	}
-	logwriter, err := newProcessLogWriter(f)
-	if err != nil {
-		return nil, fmt.Errorf(`failed to create logger: %s`, err)
+	if opt.Rows > 0 && opt.Cols > 0 {
+		if err := pty.Setsize(ptmx, &pty.Winsize{Rows: opt.Rows, Cols: opt.Cols}); err != nil {
+			ptmx.Close()
+			tty.Close()
+			return nil, fmt.Errorf("failed to set pty size: %s", err)
+		}
 	}
-	pty, tty, err := pty.Open()
+	logwriter, ownLog, err := opt.logWriter()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pty: %s", err)
+		ptmx.Close()
+		tty.Close()
+		return nil, err
 	}
 
 	cmd.Stdout = tty
@@ -184,16 +477,18 @@ func executePTY(opt *ProcessOption, cmds ...string) (*Process, error) {
 	}
 	cmd.SysProcAttr.Setctty = true
 	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Credential = opt.Credential
 
 	p := &Process{
-		Stdin:          pty,
-		cmd:            cmd,
-		logWriter:      logwriter,
-		tty:            tty,
-		pty:            pty,
-		readerChannels: map[string]*reader2chan{},
-	}
-	p.readerChannels["stdout"] = newReader2Chan(pty)
+		cmd:       cmd,
+		logWriter: logwriter,
+		ownLog:    ownLog,
+		tty:       tty,
+		pty:       ptmx,
+		exited:    make(chan struct{}),
+		outputs:   map[string]io.Reader{"stdout": ptmx},
+	}
+	p.Stdin = &stdinWriter{w: ptmx, p: p}
 
 	return p, nil
 }
@@ -3,16 +3,56 @@ package execute
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 )
 
 type tmpLog struct{ bytes.Buffer }
 
 func (t *tmpLog) Close() error { return nil }
 
+// content drops time and step to compare records
+func (l logline) content() logline {
+	l.Time, l.Step = nil, nil
+	return l
+}
+
+func TestMain(m *testing.M) {
+	Init()
+	os.Exit(m.Run())
+}
+
+func TestRlimits(t *testing.T) {
+	l := &tmpLog{}
+	limits := []Rlimit{{Resource: syscall.RLIMIT_NOFILE, Cur: 64, Max: 64}}
+	p, err := NewProcess(&ProcessOption{LogIO: l, Rlimits: limits}, "sh", "-c", "ulimit -n")
+	if err != nil {
+		t.Fatalf("failed to create process: %s", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("failed to start process: %s", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("failed to wait process: %s", err)
+	}
+	var out bytes.Buffer
+	scanProcessLog(l, nil, func(rec *LogRecord) error {
+		out.Write(rec.Data)
+		return nil
+	})
+	if out.String() != "64\n" {
+		t.Fatalf("rlimit was not applied before exec: %q", out.String())
+	}
+}
+
 func TestWaitBeforeStart(t *testing.T) {
 	l := &tmpLog{}
 	opt := &ProcessOption{LogIO: l, AllocatePTY: true}
@@ -25,6 +65,57 @@ func TestWaitBeforeStart(t *testing.T) {
 	}
 }
 
+func TestStartErrorClosesLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execute")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	opt := &ProcessOption{Dir: dir, Name: "missing"}
+	p, err := NewProcess(opt, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatalf("failed to create process: %s", err)
+	}
+	if err := p.Start(); err == nil {
+		t.Fatal("missing command started")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- FollowProcessLog(opt, make(chan struct{}), func(rec *LogRecord) error { return nil })
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to follow log: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("log was not closed")
+	}
+}
+
+// fds returns the number of open descriptors
+func fds() int {
+	files, _ := ioutil.ReadDir("/proc/self/fd")
+	return len(files)
+}
+
+func TestPTYClosed(t *testing.T) {
+	before := fds()
+	p, err := NewProcess(&ProcessOption{LogIO: &tmpLog{}, AllocatePTY: true}, "true")
+	if err != nil {
+		t.Fatalf("failed to create process: %s", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("failed to start process: %s", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("failed to wait process: %s", err)
+	}
+	if after := fds(); after != before {
+		t.Fatalf("descriptors leaked: before=%d, after=%d", before, after)
+	}
+}
+
 func TestLogging(t *testing.T) {
 	l := &tmpLog{}
 	opt := &ProcessOption{LogIO: l}
@@ -45,7 +136,7 @@ func TestLogging(t *testing.T) {
 		if err := dec.Decode(&ll); err != nil {
 			break
 		}
-		logs = append(logs, ll)
+		logs = append(logs, ll.content())
 	}
 	expected := []logline{
 		{Type: "stdout", Data: []byte("1\n"), EOF: false},
@@ -59,6 +150,63 @@ func TestLogging(t *testing.T) {
 	}
 }
 
+func TestStdinLogging(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		pty    bool
+		stdout string
+	}{
+		{"pipe", false, "abc\n"},
+		// the terminal echoes input before cat writes it
+		{"pty", true, "abc\r\nabc\r\n"},
+	} {
+		l := &tmpLog{}
+		opt := &ProcessOption{LogIO: l, AllocatePTY: c.pty}
+		p, err := NewProcess(opt, "cat")
+		if err != nil {
+			t.Fatalf("%s: failed to create process: %s", c.name, err)
+		}
+		if err := p.Start(); err != nil {
+			t.Fatalf("%s: failed to start process: %s", c.name, err)
+		}
+		p.Stdin.Write([]byte("abc\n"))
+		if err := p.CloseStdin(); err != nil {
+			t.Fatalf("%s: failed to close stdin: %s", c.name, err)
+		}
+		if err := p.Wait(); err != nil {
+			t.Fatalf("%s: failed to wait process: %s", c.name, err)
+		}
+		// output may be split where it happened to be read, so that
+		// the joined output is compared
+		var stdout []byte
+		logs := []logline{}
+		dec := json.NewDecoder(l)
+		for {
+			var ll logline
+			if err := dec.Decode(&ll); err != nil {
+				break
+			}
+			if ll.Type == "stdout" && !ll.EOF {
+				stdout = append(stdout, ll.Data...)
+				continue
+			}
+			logs = append(logs, ll.content())
+		}
+		if string(stdout) != c.stdout {
+			t.Errorf("%s: output mismatch: got=%q, expected=%q", c.name, stdout, c.stdout)
+		}
+		expected := []logline{
+			{Type: "stdin", Data: []byte("abc\n"), EOF: false},
+			{Type: "stdout", EOF: true},
+			{Type: "stderr", EOF: true},
+			{Type: "stdin", EOF: true},
+		}
+		if !reflect.DeepEqual(logs, expected) {
+			t.Errorf("%s: logs mismatch:\ngot=%+v\nexpected=%+v\n", c.name, logs, expected)
+		}
+	}
+}
+
 func TestPTYLogging(t *testing.T) {
 	l := &tmpLog{}
 	opt := &ProcessOption{LogIO: l, AllocatePTY: true}
@@ -79,7 +227,7 @@ func TestPTYLogging(t *testing.T) {
 		if err := dec.Decode(&ll); err != nil {
 			break
 		}
-		logs = append(logs, ll)
+		logs = append(logs, ll.content())
 	}
 	expected := []logline{
 		{Type: "stdout", Data: []byte("1\r\n"), EOF: false},
@@ -93,25 +241,26 @@ func TestPTYLogging(t *testing.T) {
 	}
 }
 
-func TestPTYInteractiveLog(t *testing.T) {
+// ptyLog runs a shell in a pty with input written to it by write and
+// returns its joined output and the other records of the log
+func ptyLog(t *testing.T, write func(p *Process), shell ...string) ([]byte, []logline) {
 	l := &tmpLog{}
 	opt := &ProcessOption{
 		LogIO:       l,
 		Env:         []string{"PS1=$ "},
 		AllocatePTY: true,
 	}
-	p, err := NewProcess(opt, "sh")
+	p, err := NewProcess(opt, shell...)
 	if err != nil {
 		t.Fatalf("failed to create process: %s", err)
 	}
-	if err := p.Start(); err != nil {
-		t.Fatalf("failed to start process: %s", err)
-	}
-	p.Stdin.Write([]byte("echo 1\n"))
-	p.Stdin.Write([]byte("exit\n"))
+	write(p)
 	if err := p.Wait(); err != nil {
 		t.Fatalf("failed to wait process: %s", err)
 	}
+	// output is split where it happened to be read, so that the joined
+	// output is compared
+	var stdout []byte
 	logs := []logline{}
 	dec := json.NewDecoder(l)
 	for {
@@ -119,17 +268,37 @@ func TestPTYInteractiveLog(t *testing.T) {
 		if err := dec.Decode(&ll); err != nil {
 			break
 		}
-		logs = append(logs, ll)
+		if ll.Type == "stdout" && !ll.EOF {
+			stdout = append(stdout, ll.Data...)
+			continue
+		}
+		logs = append(logs, ll.content())
+	}
+	return stdout, logs
+}
+
+func TestPTYInteractiveLog(t *testing.T) {
+	stdout, logs := ptyLog(t, func(p *Process) {
+		if err := p.Start(); err != nil {
+			t.Fatalf("failed to start process: %s", err)
+		}
+		p.Stdin.Write([]byte("echo 1\n"))
+		p.Stdin.Write([]byte("exit\n"))
+	}, "sh")
+	// the order of the echo of the terminal, prompts and output depends on
+	// when the shell reads the input
+	for _, s := range []string{"echo 1\r\n", "exit\r\n"} {
+		if !bytes.Contains(stdout, []byte(s)) {
+			t.Errorf("output does not have %q: %q", s, stdout)
+		}
+	}
+	// "1" is in the echo of the input and the output of the command
+	if n := bytes.Count(stdout, []byte("1\r\n")); n != 2 {
+		t.Errorf("output does not have the output of the command: %q", stdout)
 	}
-	out := []byte{}
-	out = append(out, []byte("echo 1\r\n")...)
-	out = append(out, []byte("exit\r\n")...)
-	out = append(out, []byte("$ echo 1\r\n")...)
-	out = append(out, []byte("1\r\n")...)
-	out = append(out, []byte("$ exit\r\n")...)
-	out = append(out, []byte("exit\r\n")...)
 	expected := []logline{
-		{Type: "stdout", Data: out, EOF: false},
+		{Type: "stdin", Data: []byte("echo 1\n"), EOF: false},
+		{Type: "stdin", Data: []byte("exit\n"), EOF: false},
 		{Type: "stdout", EOF: true},
 		{Type: "stderr", EOF: true},
 		{Type: "stdin", EOF: true},
@@ -139,6 +308,28 @@ func TestPTYInteractiveLog(t *testing.T) {
 	}
 }
 
+func TestPTYTranscript(t *testing.T) {
+	// input written before bash starts is echoed by the terminal before
+	// bash turns off echo to read it, so that the transcript is exact
+	stdout, _ := ptyLog(t, func(p *Process) {
+		p.Stdin.Write([]byte("echo 1\n"))
+		p.Stdin.Write([]byte("exit\n"))
+		if err := p.Start(); err != nil {
+			t.Fatalf("failed to start process: %s", err)
+		}
+	}, "bash", "--norc")
+	out := []byte{}
+	out = append(out, []byte("echo 1\r\n")...)
+	out = append(out, []byte("exit\r\n")...)
+	out = append(out, []byte("$ echo 1\r\n")...)
+	out = append(out, []byte("1\r\n")...)
+	out = append(out, []byte("$ exit\r\n")...)
+	out = append(out, []byte("exit\r\n")...)
+	if !bytes.Equal(stdout, out) {
+		t.Fatalf("output mismatch:\ngot=%q\nexpected=%q\n", stdout, out)
+	}
+}
+
 func TestProcessLogReader(t *testing.T) {
 	l := &tmpLog{}
 	enc := json.NewEncoder(l)
@@ -176,3 +367,413 @@ func TestProcessLogReader(t *testing.T) {
 		}
 	}
 }
+
+func TestFollowProcessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execute")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	opt := &ProcessOption{Dir: dir, Name: "follow"}
+	w, err := NewProcessLogWriter(opt)
+	if err != nil {
+		t.Fatalf("failed to create log: %s", err)
+	}
+	w.Write([]byte("1"), "stdout", 0)
+
+	out := make(chan []byte)
+	go func() {
+		var got []byte
+		err := FollowProcessLog(opt, make(chan struct{}), func(rec *LogRecord) error {
+			got = append(got, rec.Data...)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("failed to follow log: %s", err)
+		}
+		out <- got
+	}()
+	time.Sleep(2 * followInterval)
+	w.Write([]byte("2"), "stderr", 1)
+	w.Close()
+
+	select {
+	case got := <-out:
+		if string(got) != "12" {
+			t.Fatalf("output not match: got=`%s`, expected=`12`", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("follow did not return after EOF")
+	}
+}
+
+func TestCredential(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to change uid")
+	}
+	l := &tmpLog{}
+	opt := &ProcessOption{LogIO: l, Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	p, err := NewProcess(opt, "id", "-u")
+	if err != nil {
+		t.Fatalf("failed to create process: %s", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("failed to start process: %s", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("failed to wait process: %s", err)
+	}
+	var ll logline
+	if err := json.NewDecoder(l).Decode(&ll); err != nil {
+		t.Fatalf("failed to decode log: %s", err)
+	}
+	if string(ll.Data) != "65534\n" {
+		t.Fatalf("uid mismatch: got=%q expected=%q", ll.Data, "65534\n")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	l := &tmpLog{}
+	var cleaned int
+	opt := &ProcessOption{LogIO: l, Cleanup: func(pid int) {
+		cleaned = pid
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}}
+	p, err := NewProcess(opt, "sh", "-c", "sleep 10 &")
+	if err != nil {
+		t.Fatalf("failed to create process: %s", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("failed to start process: %s", err)
+	}
+	start := time.Now()
+	if err := p.Wait(); err != nil {
+		t.Fatalf("failed to wait process: %s", err)
+	}
+	if cleaned != p.Pid() {
+		t.Fatalf("cleanup not called with pid: got=%d expected=%d", cleaned, p.Pid())
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("wait blocked by leftover process: %s", d)
+	}
+}
+
+func TestLogRecordTime(t *testing.T) {
+	l := &tmpLog{}
+	l.WriteString(`{"type":"stdout","data":"b2xk","eof":false}` + "\n")
+	w, err := newProcessLogWriter(l)
+	if err != nil {
+		t.Fatalf("failed to create log: %s", err)
+	}
+	before := time.Now()
+	w.Write([]byte("new"), "stderr", 2)
+	w.Close()
+	recs := []*LogRecord{}
+	if err := scanProcessLog(l, nil, func(rec *LogRecord) error {
+		recs = append(recs, rec)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("records mismatch: %+v", recs)
+	}
+	if old := recs[0]; string(old.Data) != "old" || !old.Time.IsZero() || old.Step != -1 {
+		t.Fatalf("old record mismatch: %+v", old)
+	}
+	if rec := recs[1]; string(rec.Data) != "new" || rec.Time.Before(before) || rec.Step != 2 {
+		t.Fatalf("new record mismatch: %+v", rec)
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execute")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	opt := &ProcessOption{Dir: dir, Name: "rotate", LogLimits: LogLimits{SegmentSize: 300, MaxSize: 2000, Compress: true}}
+	w, err := NewProcessLogWriter(opt)
+	if err != nil {
+		t.Fatalf("failed to create log: %s", err)
+	}
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		line := []byte(fmt.Sprintf("line %d\n", i))
+		if err := w.Write(line, "stdout", 0); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+		if i < 10 {
+			expected = append(expected, line...)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close log: %s", err)
+	}
+	if !opt.segmentExists(3) || opt.segmentExists(20) {
+		t.Fatalf("unexpected segments in %s", dir)
+	}
+	if _, err := os.Stat(opt.segmentFile(1)); !os.IsNotExist(err) {
+		t.Fatalf("segment not compressed: %s", err)
+	}
+	var got []byte
+	truncated := 0
+	if err := ReadProcessLog(opt, func(rec *LogRecord) error {
+		if rec.Truncated {
+			truncated++
+		}
+		got = append(got, rec.Data...)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+	if truncated != 1 {
+		t.Fatalf("truncation records mismatch: got=%d expected=1", truncated)
+	}
+	if !bytes.HasPrefix(got, expected) || bytes.Contains(got, []byte("line 99")) {
+		t.Fatalf("output not match: got=`%s`", got)
+	}
+}
+
+func TestFollowRotatedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execute")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	opt := &ProcessOption{Dir: dir, Name: "follow", LogLimits: LogLimits{SegmentSize: 100}}
+	w, err := NewProcessLogWriter(opt)
+	if err != nil {
+		t.Fatalf("failed to create log: %s", err)
+	}
+	out := make(chan []byte)
+	go func() {
+		var got []byte
+		err := FollowProcessLog(opt, make(chan struct{}), func(rec *LogRecord) error {
+			got = append(got, rec.Data...)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("failed to follow log: %s", err)
+		}
+		out <- got
+	}()
+	var expected []byte
+	for i := 0; i < 20; i++ {
+		line := []byte(fmt.Sprintf("%d,", i))
+		w.Write(line, "stdout", 0)
+		expected = append(expected, line...)
+		time.Sleep(followInterval / 4)
+	}
+	w.Close()
+	select {
+	case got := <-out:
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("output not match: got=`%s`, expected=`%s`", got, expected)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("follow did not return after EOF")
+	}
+}
+
+type discardLog struct{}
+
+func (discardLog) Write(b []byte) (int, error) { return len(b), nil }
+func (discardLog) Close() error                { return nil }
+
+// BenchmarkOutput measures throughput of logging output. Each op writes
+// 256MiB, so -benchtime 8x logs 2GiB.
+func BenchmarkOutput(b *testing.B) {
+	const size = 256 << 20
+	dir, err := ioutil.TempDir("", "execute")
+	if err != nil {
+		b.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, c := range []struct {
+		name string
+		opt  func(i int) *ProcessOption
+	}{
+		{"discard", func(int) *ProcessOption { return &ProcessOption{LogIO: discardLog{}} }},
+		{"file", func(i int) *ProcessOption { return &ProcessOption{Dir: dir, Name: strconv.Itoa(i)} }},
+		{"pty", func(int) *ProcessOption { return &ProcessOption{LogIO: discardLog{}, AllocatePTY: true} }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				p, err := NewProcess(c.opt(i), "head", "-c", strconv.Itoa(size), "/dev/zero")
+				if err != nil {
+					b.Fatalf("failed to create process: %s", err)
+				}
+				if err := p.Start(); err != nil {
+					b.Fatalf("failed to start process: %s", err)
+				}
+				if err := p.Wait(); err != nil {
+					b.Fatalf("failed to wait process: %s", err)
+				}
+				os.RemoveAll(filepath.Join(dir, strconv.Itoa(i)))
+			}
+		})
+	}
+}
+
+func TestOutputComplete(t *testing.T) {
+	for _, pty := range []bool{false, true} {
+		l := &tmpLog{}
+		const size = 1 << 20
+		p, err := NewProcess(&ProcessOption{LogIO: l, AllocatePTY: pty}, "head", "-c", strconv.Itoa(size), "/dev/zero")
+		if err != nil {
+			t.Fatalf("failed to create process: %s", err)
+		}
+		if err := p.Start(); err != nil {
+			t.Fatalf("failed to start process: %s", err)
+		}
+		if err := p.Wait(); err != nil {
+			t.Fatalf("failed to wait process: %s", err)
+		}
+		n := 0
+		scanProcessLog(l, nil, func(rec *LogRecord) error {
+			n += len(rec.Data)
+			return nil
+		})
+		if n != size {
+			t.Fatalf("output lost with pty=%t: got=%d expected=%d", pty, n, size)
+		}
+	}
+}
+
+func TestLineMode(t *testing.T) {
+	type write struct {
+		data string
+		step int
+	}
+	tests := []struct {
+		name     string
+		max      int
+		writes   []write
+		expected []string
+	}{
+		{"lines", 0, []write{{"a\nbc", 0}, {"d\ne", 0}}, []string{"a\n", "bcd\n", "e"}},
+		{"progress", 0, []write{{"10%\r20%\r", 0}, {"100%\n", 0}}, []string{"10%\r", "20%\r", "100%\n"}},
+		{"crlf", 0, []write{{"x\r", 0}, {"\ny\r\n", 0}}, []string{"x\r\n", "y\r\n"}},
+		{"long", 4, []write{{"abcdefghij\n", 0}}, []string{"abcd", "efgh", "ij\n"}},
+		{"step", 0, []write{{"a", 0}, {"b\n", 1}}, []string{"b\n", "a"}},
+	}
+	for _, tt := range tests {
+		l := &tmpLog{}
+		w, err := NewProcessLogWriter(&ProcessOption{LogIO: l, Lines: &LineMode{MaxLength: tt.max}})
+		if err != nil {
+			t.Fatalf("failed to create log: %s", err)
+		}
+		for _, wr := range tt.writes {
+			if err := w.Write([]byte(wr.data), "stdout", wr.step); err != nil {
+				t.Fatalf("%s: failed to write: %s", tt.name, err)
+			}
+		}
+		w.Close()
+		got := []string{}
+		scanProcessLog(l, nil, func(rec *LogRecord) error {
+			got = append(got, string(rec.Data))
+			return nil
+		})
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Fatalf("%s: records mismatch: got=%q expected=%q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestLineModeInterleavedSteps(t *testing.T) {
+	l := &tmpLog{}
+	w, err := NewProcessLogWriter(&ProcessOption{LogIO: l, Lines: &LineMode{}})
+	if err != nil {
+		t.Fatalf("failed to create log: %s", err)
+	}
+	w.Write([]byte("hel"), "stdout", 0)
+	w.Write([]byte("other\n"), "stdout", 1)
+	w.Write([]byte("lo\n"), "stdout", 0)
+	w.Write([]byte("tail"), "stdout", 1)
+	w.Write([]byte("err"), "stderr", 0)
+	if err := w.Flush(1); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	w.Close()
+	type record struct {
+		Type string
+		Data string
+		Step int
+	}
+	got := []record{}
+	scanProcessLog(l, nil, func(rec *LogRecord) error {
+		got = append(got, record{rec.Type, string(rec.Data), rec.Step})
+		return nil
+	})
+	expected := []record{
+		{"stdout", "other\n", 1},
+		{"stdout", "hello\n", 0},
+		{"stdout", "tail", 1},
+		{"stderr", "err", 0},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("records mismatch: got=%+v expected=%+v", got, expected)
+	}
+}
+
+func TestPartialLine(t *testing.T) {
+	defer func(d time.Duration) { partialLineDelay = d }(partialLineDelay)
+	partialLineDelay = 10 * time.Millisecond
+	l := &tmpLog{}
+	w, err := NewProcessLogWriter(&ProcessOption{LogIO: l, Lines: &LineMode{}})
+	if err != nil {
+		t.Fatalf("failed to create log: %s", err)
+	}
+	w.Write([]byte("password: "), "stdout", 0)
+	time.Sleep(100 * time.Millisecond)
+	w.m.Lock()
+	written := l.Bytes()
+	w.m.Unlock()
+	if !bytes.Contains(written, []byte(`"data":"cGFzc3dvcmQ6IA=="`)) {
+		t.Fatalf("incomplete line was not written: %s", written)
+	}
+	w.Close()
+}
+
+func TestFailedStartClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execute")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// the log cannot be created under a regular file
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	for _, c := range []struct {
+		name string
+		pty  bool
+		// start is true when the log is created and Start fails
+		start bool
+	}{
+		{"pipe log", false, false},
+		{"pty log", true, false},
+		{"pipe start", false, true},
+		{"pty start", true, true},
+	} {
+		before := fds()
+		opt := &ProcessOption{Dir: file, Name: "log", AllocatePTY: c.pty}
+		if c.start {
+			opt.Dir = dir
+		}
+		p, err := NewProcess(opt, filepath.Join(dir, "missing"))
+		if err == nil {
+			if err := p.Start(); err == nil {
+				t.Fatalf("%s: missing command started", c.name)
+			}
+		} else if c.start {
+			t.Fatalf("%s: failed to create process: %s", c.name, err)
+		}
+		if after := fds(); after != before {
+			t.Errorf("%s: descriptors leaked: before=%d, after=%d", c.name, before, after)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package execute
 
 import (
 	"io"
-	"time"
+	"sync"
 )
 
 type multiIO struct {
@@ -44,41 +44,12 @@ func (m multiIO) Close() error {
 	return err
 }
 
-type reader2chan struct {
-	reader  io.Reader
-	Channel chan []byte
-	fin     chan struct{}
-}
-
-func newReader2Chan(r io.Reader) *reader2chan {
-	return &reader2chan{
-		reader:  r,
-		Channel: make(chan []byte),
-		fin:     make(chan struct{}),
-	}
-}
-
-func (r *reader2chan) Start() {
-	for {
-		select {
-		case <-r.fin:
-			close(r.Channel)
-			return
-		case <-time.After(100 * time.Millisecond):
-			buf := make([]byte, 1024)
-			n, err := r.reader.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					continue
-				}
-				close(r.Channel)
-				return
-			}
-			r.Channel <- buf[:n]
-		}
-	}
-}
+// outputBufferSize is the size of buffers which output is read into
+const outputBufferSize = 32 * 1024
 
-func (r *reader2chan) Stop() {
-	r.fin <- struct{}{}
+var outputBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, outputBufferSize)
+		return &b
+	},
 }
@@ -0,0 +1,173 @@
+package execute
+
+import (
+	"sort"
+	"time"
+)
+
+// LineMode splits log records at the end of lines instead of where output
+// happened to be read, so that each record holds one line.
+type LineMode struct {
+	// MaxLength splits longer lines into records of it. 0 is
+	// defaultMaxLineLength.
+	MaxLength int
+}
+
+const defaultMaxLineLength = 64 * 1024
+
+func (m *LineMode) maxLength() int {
+	if m.MaxLength <= 0 {
+		return defaultMaxLineLength
+	}
+	return m.MaxLength
+}
+
+// partialLineDelay is how long an incomplete line is held before it is
+// written, so that prompts and the like still appear while following
+var partialLineDelay = time.Second
+
+// lineKey identifies the incomplete line of a stream of a command, since
+// commands running in parallel share a log
+type lineKey struct {
+	logtype string
+	step    int
+}
+
+// pendingLine is the incomplete line of a stream of a command
+type pendingLine struct {
+	data []byte
+	// time is when the first byte of the line was written
+	time  *time.Time
+	timer *time.Timer
+}
+
+// lineEnd returns the length of the first line of b, or -1 if b has no
+// complete line. A line ends with "\n", or with "\r" not followed by "\n"
+// which progress bars use to redraw the line. A "\r" at the end of b is
+// incomplete until the next byte is known.
+func lineEnd(b []byte) int {
+	for i, c := range b {
+		switch c {
+		case '\n':
+			return i + 1
+		case '\r':
+			if i+1 < len(b) && b[i+1] != '\n' {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// writeLines writes complete lines of the stream with data appended as
+// records, and holds the rest. It must be called with w.m held.
+func (w *ProcessLogWriter) writeLines(data []byte, logtype string, step int) error {
+	key := lineKey{logtype, step}
+	p := w.pending[key]
+	now := w.now()
+	if p == nil {
+		p = &pendingLine{time: now}
+		w.pending[key] = p
+	}
+	p.data = append(p.data, data...)
+	max := w.lines.maxLength()
+	off := 0
+	for {
+		rest := p.data[off:]
+		n := lineEnd(rest)
+		if n < 0 || n > max {
+			if len(rest) < max {
+				break
+			}
+			n = max
+		}
+		if err := w.encode(&logline{Type: logtype, Data: rest[:n], Time: p.time, Step: &step}); err != nil {
+			return err
+		}
+		off += n
+		// the rest was written by this call
+		p.time = now
+	}
+	if off == 0 {
+		if p.timer == nil {
+			p.timer = time.AfterFunc(partialLineDelay, func() { w.flushPending(key, p) })
+		}
+		return nil
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if off == len(p.data) {
+		delete(w.pending, key)
+		return nil
+	}
+	p.data = append(p.data[:0], p.data[off:]...)
+	p.timer = time.AfterFunc(partialLineDelay, func() { w.flushPending(key, p) })
+	return nil
+}
+
+// flushPending writes p if it is still the incomplete line of key
+func (w *ProcessLogWriter) flushPending(key lineKey, p *pendingLine) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.pending[key] != p {
+		return
+	}
+	if err := w.flushLine(key); err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// flushLine writes the incomplete line of key as a record. It must be
+// called with w.m held.
+func (w *ProcessLogWriter) flushLine(key lineKey) error {
+	p := w.pending[key]
+	if p == nil {
+		return nil
+	}
+	delete(w.pending, key)
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	step := key.step
+	return w.encode(&logline{Type: key.logtype, Data: p.data, Time: p.time, Step: &step})
+}
+
+// Flush writes incomplete lines of the command at index step. Commands
+// sharing a log should flush it after they exit.
+func (w *ProcessLogWriter) Flush(step int) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	for _, t := range logTypes {
+		if err := w.flushLine(lineKey{t, step}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushAll writes incomplete lines of all commands in order of streams and
+// steps. It must be called with w.m held.
+func (w *ProcessLogWriter) flushAll() error {
+	keys := make([]lineKey, 0, len(w.pending))
+	for k := range w.pending {
+		keys = append(keys, k)
+	}
+	order := map[string]int{}
+	for i, t := range logTypes {
+		order[t] = i
+	}
+	sort.Slice(keys, func(i, k int) bool {
+		if keys[i].logtype != keys[k].logtype {
+			return order[keys[i].logtype] < order[keys[k].logtype]
+		}
+		return keys[i].step < keys[k].step
+	})
+	for _, k := range keys {
+		if err := w.flushLine(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,42 +4,211 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"os"
+	"sync"
+	"time"
 )
 
-type processLogWriter struct {
-	out io.WriteCloser
+// ProcessLogWriter writes process output as JSON lines
+type ProcessLogWriter struct {
+	out   io.WriteCloser
+	err   error
+	m     sync.Mutex
+	start time.Time
+	// buf is reused to encode records
+	buf bytes.Buffer
 	enc *json.Encoder
-	err error
+
+	// opt is set for logs in files, which can be rotated
+	opt       *ProcessOption
+	limits    LogLimits
+	segment   int
+	size      int64
+	total     int64
+	truncated bool
+	// compressing counts segments being compressed, whose error is err
+	compressing sync.WaitGroup
+
+	// lines is set in line mode, where pending holds incomplete lines
+	lines   *LineMode
+	pending map[lineKey]*pendingLine
 }
 
-func newProcessLogWriter(out io.WriteCloser) (*processLogWriter, error) {
-	l := &processLogWriter{}
+// logTypes are the streams recorded in a log
+var logTypes = []string{"stdout", "stderr", "stdin"}
+
+// NewProcessLogWriter creates the log file of opt and returns new ProcessLogWriter
+func NewProcessLogWriter(opt *ProcessOption) (*ProcessLogWriter, error) {
+	f, err := opt.writeCloser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %s", err)
+	}
+	l, err := newProcessLogWriter(f)
+	if err != nil {
+		return nil, err
+	}
+	if opt.LogIO == nil {
+		l.opt = opt
+		l.limits = opt.LogLimits
+	}
+	l.lines = opt.Lines
+	return l, nil
+}
+
+func newProcessLogWriter(out io.WriteCloser) (*ProcessLogWriter, error) {
+	l := &ProcessLogWriter{}
 	l.out = out
-	l.enc = json.NewEncoder(out)
+	l.start = time.Now()
+	l.enc = json.NewEncoder(&l.buf)
+	l.pending = map[lineKey]*pendingLine{}
 	return l, nil
 }
 
-func (w *processLogWriter) Close() error {
-	l := logline{EOF: true}
-	for _, t := range []string{"stdout", "stderr", "stdin"} {
+// encode writes l. Output over MaxSize is dropped after a truncation
+// record, and a new segment starts when the current one would exceed
+// SegmentSize. It must be called with w.m held.
+func (w *ProcessLogWriter) encode(l *logline) error {
+	w.buf.Reset()
+	if err := w.enc.Encode(l); err != nil {
+		return err
+	}
+	if !l.EOF && w.limits.MaxSize > 0 && w.total+int64(w.buf.Len()) > w.limits.MaxSize {
+		if w.truncated {
+			return nil
+		}
+		w.truncated = true
+		w.buf.Reset()
+		if err := w.enc.Encode(&logline{Type: l.Type, Time: l.Time, Step: l.Step, Truncated: true}); err != nil {
+			return err
+		}
+	}
+	b := w.buf.Bytes()
+	if w.opt != nil && w.limits.SegmentSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.limits.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.out.Write(b)
+	w.size += int64(n)
+	w.total += int64(n)
+	return err
+}
+
+// rotate closes the current segment and starts the next one. It must be
+// called with w.m held.
+func (w *ProcessLogWriter) rotate() error {
+	if err := w.out.Close(); err != nil {
+		return fmt.Errorf("failed to close log segment: %s", err)
+	}
+	w.closed(w.opt.segmentFile(w.segment))
+	f, err := os.Create(w.opt.segmentFile(w.segment + 1))
+	if err != nil {
+		return fmt.Errorf("failed to create log segment: %s", err)
+	}
+	w.segment++
+	w.out = f
+	w.size = 0
+	return nil
+}
+
+// closed compresses the closed segment at path in background if enabled
+func (w *ProcessLogWriter) closed(path string) {
+	if !w.limits.Compress {
+		return
+	}
+	w.compressing.Add(1)
+	go func() {
+		defer w.compressing.Done()
+		if err := compressFile(path); err != nil {
+			w.m.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.m.Unlock()
+		}
+	}()
+}
+
+// now returns the time of a record. It advances by the monotonic clock
+// from the start of the log, so that records are in order of time even if
+// the wall clock is changed.
+func (w *ProcessLogWriter) now() *time.Time {
+	t := w.start.Add(time.Since(w.start)).Round(0)
+	return &t
+}
+
+// Close writes incomplete lines and EOF of all streams and closes the log.
+// It waits until segments are compressed.
+func (w *ProcessLogWriter) Close() error {
+	w.m.Lock()
+	if err := w.flushAll(); err != nil {
+		w.m.Unlock()
+		return err
+	}
+	l := logline{EOF: true, Time: w.now()}
+	for _, t := range logTypes {
 		l.Type = t
-		err := w.enc.Encode(l)
-		if err != nil {
+		if err := w.encode(&l); err != nil {
+			w.m.Unlock()
 			return err
 		}
 	}
-	return w.out.Close()
+	err := w.out.Close()
+	if err == nil && w.opt != nil {
+		w.closed(w.opt.segmentFile(w.segment))
+	}
+	w.m.Unlock()
+	w.compressing.Wait()
+	if err != nil {
+		return err
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.err
 }
 
-func (w *processLogWriter) Write(line []byte, logtype string) error {
-	return w.enc.Encode(&logline{Type: logtype, Data: line})
+// Write writes output of the command at index step of its run
+func (w *ProcessLogWriter) Write(line []byte, logtype string, step int) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.lines != nil {
+		return w.writeLines(line, logtype, step)
+	}
+	return w.encode(&logline{Type: logtype, Data: line, Time: w.now(), Step: &step})
 }
 
 type logline struct {
-	Type string `json:"type"`
-	Data []byte `json:"data"`
-	EOF  bool   `json:"eof"`
+	Type string     `json:"type"`
+	Data []byte     `json:"data"`
+	EOF  bool       `json:"eof"`
+	Time *time.Time `json:"time,omitempty"`
+	Step *int       `json:"step,omitempty"`
+	// Truncated marks that following output was dropped by the size limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// LogRecord is output read from a log. Time is zero and Step is -1 in logs
+// written before they were recorded. Truncated is true for the record
+// marking that following output was dropped, which has no data.
+type LogRecord struct {
+	Type      string
+	Data      []byte
+	Time      time.Time
+	Step      int
+	Truncated bool
+}
+
+func (l *logline) record() *LogRecord {
+	rec := &LogRecord{Type: l.Type, Data: l.Data, Step: -1, Truncated: l.Truncated}
+	if l.Time != nil {
+		rec.Time = *l.Time
+	}
+	if l.Step != nil {
+		rec.Step = *l.Step
+	}
+	return rec
 }
 
 //ProcessLogReader represents reader for process log
@@ -107,7 +276,6 @@ func (r *ProcessLogReader) writeLine(l *logline) (closed bool) {
 
 // Start starts read process
 func (r *ProcessLogReader) Start() {
-	line := logline{}
 	var (
 		closed int
 	)
@@ -127,6 +295,7 @@ func (r *ProcessLogReader) Start() {
 				r.err = err
 				return
 			}
+			line := logline{}
 			if err := json.Unmarshal(l, &line); err != nil {
 				r.err = err
 				return
@@ -144,6 +313,75 @@ func (r *ProcessLogReader) Close() error {
 	return r.f.Close()
 }
 
+// ReadProcessLog calls fn with each output record in the order they were
+// written, until the end of the log.
+func ReadProcessLog(opt *ProcessOption, fn func(rec *LogRecord) error) error {
+	f, err := opt.readCloser()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanProcessLog(f, nil, fn)
+}
+
+// FollowProcessLog is like ReadProcessLog but waits for new records at the
+// end of the log until all streams reach EOF. After stop is closed it returns
+// at the next end of the log.
+func FollowProcessLog(opt *ProcessOption, stop <-chan struct{}, fn func(rec *LogRecord) error) error {
+	f, err := opt.readCloser()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanProcessLog(f, stop, fn)
+}
+
+// followInterval is the interval to check new records at the end of the log
+var followInterval = 100 * time.Millisecond
+
+// scanProcessLog reads records from r. It follows r when stop is not nil.
+func scanProcessLog(r io.Reader, stop <-chan struct{}, fn func(rec *LogRecord) error) error {
+	br := bufio.NewReader(r)
+	closed := map[string]bool{}
+	var buf []byte
+	for {
+		b, err := br.ReadBytes('\n')
+		buf = append(buf, b...)
+		if err == io.EOF {
+			if stop == nil {
+				return nil
+			}
+			select {
+			case <-stop:
+				stop = nil
+			case <-time.After(followInterval):
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var l logline
+		if err := json.Unmarshal(buf, &l); err != nil {
+			return fmt.Errorf("failed to parse log: %s", err)
+		}
+		buf = nil
+		if l.EOF {
+			closed[l.Type] = true
+			if len(closed) == 3 { // stdin/stdout/stderr
+				return nil
+			}
+			continue
+		}
+		if len(l.Data) == 0 && !l.Truncated {
+			continue
+		}
+		if err := fn(l.record()); err != nil {
+			return err
+		}
+	}
+}
+
 type logBuffer struct {
 	c chan []byte
 }
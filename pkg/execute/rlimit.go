@@ -0,0 +1,93 @@
+package execute
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Rlimit is a resource limit like unix.RLIMIT_NOFILE
+type Rlimit struct {
+	Resource int
+	Cur      uint64
+	Max      uint64
+}
+
+// rlimitHelper is argv[0] of the program re-executed to apply rlimits to
+// itself before it executes a command, so that the command never runs
+// without them
+const rlimitHelper = "gj-rlimit-exec"
+
+// Init runs the rlimit helper if the program was executed as it, and does
+// nothing otherwise. Programs starting processes with Rlimits must call it
+// at the start of main.
+func Init() {
+	if len(os.Args) < 4 || os.Args[0] != rlimitHelper {
+		return
+	}
+	// arguments are the limits, the path and the arguments of the command
+	limits, err := parseRlimits(os.Args[1])
+	if err == nil {
+		err = applyRlimits(limits)
+	}
+	if err == nil {
+		err = syscall.Exec(os.Args[2], os.Args[3:], os.Environ())
+		err = fmt.Errorf("failed to execute %s: %s", os.Args[2], err)
+	}
+	fmt.Fprintf(os.Stderr, "gj: %s\n", err)
+	os.Exit(127)
+}
+
+// withRlimits makes cmd start through the rlimit helper
+func withRlimits(cmd *exec.Cmd, limits []Rlimit) {
+	args := []string{rlimitHelper, formatRlimits(limits), cmd.Path}
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+}
+
+func formatRlimits(limits []Rlimit) string {
+	s := make([]string, len(limits))
+	for i, l := range limits {
+		s[i] = fmt.Sprintf("%d:%d:%d", l.Resource, l.Cur, l.Max)
+	}
+	return strings.Join(s, ",")
+}
+
+func parseRlimits(s string) ([]Rlimit, error) {
+	limits := []Rlimit{}
+	for _, f := range strings.Split(s, ",") {
+		v := strings.Split(f, ":")
+		if len(v) != 3 {
+			return nil, fmt.Errorf("invalid rlimit: %s", f)
+		}
+		var (
+			l   Rlimit
+			err error
+		)
+		if l.Resource, err = strconv.Atoi(v[0]); err != nil {
+			return nil, fmt.Errorf("invalid rlimit: %s", f)
+		}
+		if l.Cur, err = strconv.ParseUint(v[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid rlimit: %s", f)
+		}
+		if l.Max, err = strconv.ParseUint(v[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid rlimit: %s", f)
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+// applyRlimits applies limits to the current process. syscall.Setrlimit
+// keeps the runtime from restoring RLIMIT_NOFILE on exec.
+func applyRlimits(limits []Rlimit) error {
+	for _, l := range limits {
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Cur, Max: l.Max}); err != nil {
+			return fmt.Errorf("failed to set rlimit %d: %s", l.Resource, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package execute
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// LogLimits caps the size of a log
+type LogLimits struct {
+	// SegmentSize starts a new numbered segment when the current one would
+	// exceed it. 0 disables rotation.
+	SegmentSize int64
+	// MaxSize is the total size of records kept. Output beyond it is dropped
+	// after a truncation record. 0 is unlimited.
+	MaxSize int64
+	// Compress gzips segments after they are closed
+	Compress bool
+}
+
+// segmentFile returns the path of segment n of the log. Segment 0 is the
+// log file itself, so that logs without rotation have one segment.
+func (o *ProcessOption) segmentFile(n int) string {
+	if n == 0 {
+		return o.logFile()
+	}
+	return fmt.Sprintf("%s/%s/log.%d.json", o.Dir, o.Name, n)
+}
+
+// openSegment opens segment n, or its compressed file
+func (o *ProcessOption) openSegment(n int) (io.ReadCloser, error) {
+	path := o.segmentFile(n)
+	f, err := os.Open(path)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	// the compressed file is complete before the segment is removed
+	gz, err := os.Open(path + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		gz.Close()
+		return nil, fmt.Errorf("failed to read `%s.gz`: %s", path, err)
+	}
+	return &gzipFile{zr, gz}, nil
+}
+
+func (o *ProcessOption) segmentExists(n int) bool {
+	path := o.segmentFile(n)
+	for _, p := range []string{path, path + ".gz"} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// LogExists returns true if the log of Dir and Name was created
+func LogExists(opt *ProcessOption) bool {
+	return opt.segmentExists(0)
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// segmentReader reads segments of a log in order as one stream. It
+// returns io.EOF at the end of the last segment, which may grow later.
+type segmentReader struct {
+	opt *ProcessOption
+	n   int
+	cur io.ReadCloser
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.cur.Read(p)
+		if n > 0 {
+			// gzip returns io.EOF with the last data
+			return n, nil
+		}
+		if err != io.EOF {
+			return n, err
+		}
+		if !r.opt.segmentExists(r.n + 1) {
+			return 0, io.EOF
+		}
+		// the writer closes a segment before creating the next one, so
+		// the current segment is complete after reading it once more
+		if n, err = r.cur.Read(p); n > 0 {
+			return n, nil
+		} else if err != io.EOF {
+			return n, err
+		}
+		next, err := r.opt.openSegment(r.n + 1)
+		if err != nil {
+			return 0, err
+		}
+		r.cur.Close()
+		r.cur = next
+		r.n++
+	}
+}
+
+func (r *segmentReader) Close() error {
+	return r.cur.Close()
+}
+
+// compressFile replaces path with path.gz
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compress `%s`: %s", path, err)
+	}
+	return os.Remove(path)
+}
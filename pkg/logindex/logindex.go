@@ -0,0 +1,254 @@
+// Package logindex keeps trigrams of the output of a log, so that searches
+// can skip logs which cannot contain a match.
+package logindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// version changes when indexes must be rebuilt. Version 1 joined output
+// of commands running in parallel.
+const version = 2
+
+// maxTrigrams caps trigrams kept for a stream. A stream with more cannot
+// be skipped.
+const maxTrigrams = 1 << 16
+
+// Index is trigrams of each stream of a log and the time range of its records
+type Index struct {
+	Version int                `json:"version"`
+	First   time.Time          `json:"first,omitempty"`
+	Last    time.Time          `json:"last,omitempty"`
+	Streams map[string]*Stream `json:"streams"`
+}
+
+// Stream is trigrams of output of a stream
+type Stream struct {
+	// Trigrams are sorted 3-byte trigrams of output with ASCII letters
+	// lowered
+	Trigrams []byte `json:"trigrams"`
+	// Full is true when output had more than maxTrigrams
+	Full bool `json:"full,omitempty"`
+}
+
+// Builder collects trigrams of records added in order
+type Builder struct {
+	first, last time.Time
+	streams     map[string]*builderStream
+}
+
+type builderStream struct {
+	trigrams map[uint32]bool
+	full     bool
+	// tails are the last 2 bytes by step, which start trigrams with the
+	// next record of the step, since commands running in parallel share
+	// a log
+	tails map[int][]byte
+}
+
+// NewBuilder returns an empty Builder
+func NewBuilder() *Builder {
+	return &Builder{streams: map[string]*builderStream{}}
+}
+
+// Add adds data written to stream by the command at index step at t. t may
+// be zero and step -1 for old logs.
+func (b *Builder) Add(stream string, step int, data []byte, t time.Time) {
+	if !t.IsZero() {
+		if b.first.IsZero() || t.Before(b.first) {
+			b.first = t
+		}
+		if t.After(b.last) {
+			b.last = t
+		}
+	}
+	s := b.streams[stream]
+	if s == nil {
+		s = &builderStream{trigrams: map[uint32]bool{}, tails: map[int][]byte{}}
+		b.streams[stream] = s
+	}
+	if s.full {
+		return
+	}
+	tail := s.tails[step]
+	head := data
+	if len(head) > 2 {
+		head = head[:2]
+	}
+	head = append(tail, head...)
+	for i := 0; i < len(tail) && i+3 <= len(head); i++ {
+		s.trigrams[trigram(head[i:])] = true
+	}
+	for i := 0; i+3 <= len(data); i++ {
+		s.trigrams[trigram(data[i:])] = true
+	}
+	if len(s.trigrams) > maxTrigrams {
+		s.full = true
+		s.trigrams = nil
+		return
+	}
+	if len(data) >= 2 {
+		head = data[len(data)-2:]
+	} else if len(head) > 2 {
+		head = head[len(head)-2:]
+	}
+	s.tails[step] = append(tail[:0], head...)
+}
+
+// Index returns the index of records added so far
+func (b *Builder) Index() *Index {
+	idx := &Index{Version: version, First: b.first, Last: b.last, Streams: map[string]*Stream{}}
+	for name, s := range b.streams {
+		if s.full {
+			idx.Streams[name] = &Stream{Full: true}
+			continue
+		}
+		keys := make([]int, 0, len(s.trigrams))
+		for t := range s.trigrams {
+			keys = append(keys, int(t))
+		}
+		sort.Ints(keys)
+		buf := make([]byte, 0, len(keys)*3)
+		for _, t := range keys {
+			buf = append(buf, byte(t>>16), byte(t>>8), byte(t))
+		}
+		idx.Streams[name] = &Stream{Trigrams: buf}
+	}
+	return idx
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func trigram(b []byte) uint32 {
+	return uint32(lower(b[0]))<<16 | uint32(lower(b[1]))<<8 | uint32(lower(b[2]))
+}
+
+func (s *Stream) has(t uint32) bool {
+	n := len(s.Trigrams) / 3
+	i := sort.Search(n, func(i int) bool {
+		return trigram3(s.Trigrams[i*3:]) >= t
+	})
+	return i < n && trigram3(s.Trigrams[i*3:]) == t
+}
+
+func trigram3(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// Contains returns false if output of stream cannot contain all of literals
+func (idx *Index) Contains(stream string, literals []string) bool {
+	s := idx.Streams[stream]
+	if s == nil {
+		return false
+	}
+	if s.Full {
+		return true
+	}
+	for _, l := range literals {
+		for i := 0; i+3 <= len(l); i++ {
+			if !s.has(trigram([]byte(l[i:]))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Overlaps returns false if no record was written between since and until.
+// Zero since or until is unbounded.
+func (idx *Index) Overlaps(since, until time.Time) bool {
+	if since.IsZero() && until.IsZero() {
+		return true
+	}
+	if idx.First.IsZero() {
+		// records without time are not selected by time
+		return false
+	}
+	return (since.IsZero() || !idx.Last.Before(since)) && (until.IsZero() || !idx.First.After(until))
+}
+
+// Required returns literal strings which every match of re contains
+func Required(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return []string{string(re.Rune)}
+		}
+		// the index folds ASCII letters only
+		b := make([]byte, len(re.Rune))
+		for i, r := range re.Rune {
+			if r >= utf8.RuneSelf {
+				return nil
+			}
+			b[i] = lower(byte(r))
+		}
+		return []string{string(b)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return Required(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return Required(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var lits []string
+		for _, sub := range re.Sub {
+			lits = append(lits, Required(sub)...)
+		}
+		return lits
+	}
+	return nil
+}
+
+// Load reads the index at path. It returns an error for indexes of other
+// versions.
+func Load(path string) (*Index, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{}
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %s", err)
+	}
+	if idx.Version != version {
+		return nil, fmt.Errorf("index version %d is not supported", idx.Version)
+	}
+	return idx, nil
+}
+
+// Save writes idx to path atomically
+func (idx *Index) Save(path string) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create index: %s", err)
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save index: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package logindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"testing"
+	"time"
+)
+
+func TestContains(t *testing.T) {
+	b := NewBuilder()
+	for _, s := range []string{"conn", "ection ", "R", "e", "fused\n"} {
+		b.Add("stderr", 0, []byte(s), time.Time{})
+	}
+	b.Add("stdout", 0, []byte("ok\n"), time.Time{})
+	idx := b.Index()
+	tests := []struct {
+		stream   string
+		literals []string
+		expected bool
+	}{
+		{"stderr", []string{"connection refused"}, true},
+		{"stderr", []string{"CONNECTION", "refused"}, true},
+		{"stderr", []string{"connection accepted"}, false},
+		{"stdout", []string{"connection"}, false},
+		{"stdout", []string{"ok"}, true},
+		{"stdin", nil, false},
+	}
+	for _, tt := range tests {
+		if got := idx.Contains(tt.stream, tt.literals); got != tt.expected {
+			t.Fatalf("%s %q: got=%t expected=%t", tt.stream, tt.literals, got, tt.expected)
+		}
+	}
+}
+
+func TestContainsParallelSteps(t *testing.T) {
+	// records of two steps interleave in the log
+	b := NewBuilder()
+	for _, r := range []struct {
+		step int
+		data string
+	}{
+		{0, "conn"}, {1, "tim"}, {0, "ection refused\n"}, {1, "eout\n"},
+	} {
+		b.Add("stderr", r.step, []byte(r.data), time.Time{})
+	}
+	idx := b.Index()
+	for _, tt := range []struct {
+		literals []string
+		expected bool
+	}{
+		{[]string{"connection refused"}, true},
+		{[]string{"timeout"}, true},
+		{[]string{"conntim"}, false},
+		{[]string{"timection"}, false},
+	} {
+		if got := idx.Contains("stderr", tt.literals); got != tt.expected {
+			t.Errorf("%q: got=%t expected=%t", tt.literals, got, tt.expected)
+		}
+	}
+}
+
+func TestFull(t *testing.T) {
+	b := NewBuilder()
+	for i := 0; i < 100000; i++ {
+		b.Add("stdout", 0, []byte{byte(i >> 16), byte(i >> 8), byte(i)}, time.Time{})
+	}
+	idx := b.Index()
+	if !idx.Streams["stdout"].Full || !idx.Contains("stdout", []string{"never printed"}) {
+		t.Fatalf("stream with many trigrams must not be skipped")
+	}
+}
+
+func TestRequired(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"connection refused", []string{"connection refused"}},
+		{"error: .* failed", []string{"error: ", " failed"}},
+		{"(timeout|refused)", nil},
+		{"(?i)panic", []string{"panic"}},
+		{"x(abc)+y?", []string{"x", "abc"}},
+		{"(?i)ärger", nil},
+	}
+	for _, tt := range tests {
+		re, err := syntax.Parse(tt.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", tt.pattern, err)
+		}
+		if got := Required(re.Simplify()); !reflect.DeepEqual(got, tt.expected) {
+			t.Fatalf("%s: got=%q expected=%q", tt.pattern, got, tt.expected)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logindex")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now().Round(0)
+	b := NewBuilder()
+	b.Add("stdout", 0, []byte("hello"), now)
+	b.Add("stdout", 0, []byte(" world"), now.Add(time.Minute))
+	path := filepath.Join(dir, "index.json")
+	if err := b.Index().Save(path); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+	idx, err := Load(path)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if !idx.Contains("stdout", []string{"o w"}) {
+		t.Fatalf("loaded index lost trigrams")
+	}
+	if !idx.Overlaps(now.Add(30*time.Second), time.Time{}) || idx.Overlaps(now.Add(2*time.Minute), time.Time{}) || idx.Overlaps(time.Time{}, now.Add(-time.Second)) {
+		t.Fatalf("time range mismatch: %s - %s", idx.First, idx.Last)
+	}
+}
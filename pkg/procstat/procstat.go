@@ -0,0 +1,163 @@
+package procstat
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, which is 100 on Linux
+const clockTicks = 100
+
+// Stat is resource usage of a process read from /proc
+type Stat struct {
+	PID  int
+	Comm string
+	// State is like R (running), S (sleeping) or Z (zombie)
+	State byte
+	PPID  int
+	PGID  int
+	SID   int
+	// Start is the time the process started in clock ticks after boot,
+	// which tells a process from another one reusing its PID
+	Start uint64
+	UTime time.Duration
+	STime time.Duration
+	// RSS is resident set size in bytes
+	RSS int64
+	// ReadBytes and WriteBytes are bytes read from and written to storage.
+	// They are 0 when /proc/<pid>/io is not readable.
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+// Read returns the stat of pid
+func Read(pid int) (*Stat, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseStat(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stat of %d: %s", pid, err)
+	}
+	if f, err := os.Open(fmt.Sprintf("/proc/%d/io", pid)); err == nil {
+		s.ReadBytes, s.WriteBytes = parseIO(bufio.NewScanner(f))
+		f.Close()
+	}
+	return s, nil
+}
+
+// parseStat parses a line of /proc/<pid>/stat
+func parseStat(line string) (*Stat, error) {
+	// comm may contain spaces and parentheses
+	i := strings.IndexByte(line, '(')
+	j := strings.LastIndexByte(line, ')')
+	if i < 0 || j < i {
+		return nil, fmt.Errorf("invalid stat: %s", line)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line[:i]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pid: %s", line)
+	}
+	f := strings.Fields(line[j+1:])
+	// f[0] is field 3 (state) of proc(5)
+	if len(f) < 22 {
+		return nil, fmt.Errorf("too few fields: %s", line)
+	}
+	n := make([]int64, len(f))
+	for _, k := range []int{1, 2, 3, 11, 12, 19, 21} {
+		if n[k], err = strconv.ParseInt(f[k], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid field %d: %s", k+3, line)
+		}
+	}
+	return &Stat{
+		PID:   pid,
+		Comm:  line[i+1 : j],
+		State: f[0][0],
+		PPID:  int(n[1]),
+		PGID:  int(n[2]),
+		SID:   int(n[3]),
+		Start: uint64(n[19]),
+		UTime: time.Duration(n[11]) * time.Second / clockTicks,
+		STime: time.Duration(n[12]) * time.Second / clockTicks,
+		RSS:   n[21] * int64(os.Getpagesize()),
+	}, nil
+}
+
+func parseIO(sc *bufio.Scanner) (read, write int64) {
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) != 2 {
+			continue
+		}
+		v, _ := strconv.ParseInt(f[1], 10, 64)
+		switch f[0] {
+		case "read_bytes:":
+			read = v
+		case "write_bytes:":
+			write = v
+		}
+	}
+	return read, write
+}
+
+// List returns stats of all processes. Processes which exit while
+// reading are skipped.
+func List() ([]*Stat, error) {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	stats := []*Stat{}
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(d))
+		if err != nil {
+			continue
+		}
+		s, err := Read(pid)
+		if err != nil {
+			continue
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// Alive returns true if s is still running and not a zombie
+func Alive(s *Stat) bool {
+	cur, err := Read(s.PID)
+	return err == nil && cur.Start == s.Start && cur.State != 'Z'
+}
+
+// Tree returns stats of processes matching root and their descendants
+func Tree(stats []*Stat, root func(*Stat) bool) []*Stat {
+	children := map[int][]*Stat{}
+	for _, s := range stats {
+		children[s.PPID] = append(children[s.PPID], s)
+	}
+	seen := map[int]bool{}
+	group := []*Stat{}
+	var walk func(s *Stat)
+	walk = func(s *Stat) {
+		if seen[s.PID] {
+			return
+		}
+		seen[s.PID] = true
+		group = append(group, s)
+		for _, c := range children[s.PID] {
+			walk(c)
+		}
+	}
+	for _, s := range stats {
+		if root(s) {
+			walk(s)
+		}
+	}
+	return group
+}
@@ -0,0 +1,58 @@
+package procstat
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseStat(t *testing.T) {
+	line := "1234 (my (odd) cmd) S 1 1234 1234 0 -1 4194560 100 0 0 0 250 30 0 0 20 0 1 0 100 1000 42 18446744073709551615"
+	s, err := parseStat(line)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if s.PID != 1234 || s.Comm != "my (odd) cmd" || s.State != 'S' || s.PPID != 1 || s.PGID != 1234 || s.SID != 1234 || s.Start != 100 {
+		t.Fatalf("ids mismatch: %+v", s)
+	}
+	if s.UTime != 2500*time.Millisecond || s.STime != 300*time.Millisecond {
+		t.Fatalf("cpu mismatch: %+v", s)
+	}
+	if s.RSS != 42*int64(os.Getpagesize()) {
+		t.Fatalf("rss mismatch: %+v", s)
+	}
+}
+
+func TestParseIO(t *testing.T) {
+	io := "rchar: 10\nwchar: 20\nread_bytes: 4096\nwrite_bytes: 8192\n"
+	r, w := parseIO(bufio.NewScanner(strings.NewReader(io)))
+	if r != 4096 || w != 8192 {
+		t.Fatalf("io mismatch: read=%d write=%d", r, w)
+	}
+}
+
+func TestTree(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 5 & sleep 5")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	stats, err := List()
+	if err != nil {
+		t.Fatalf("failed to list: %s", err)
+	}
+	pid := cmd.Process.Pid
+	tree := Tree(stats, func(s *Stat) bool { return s.PID == pid })
+	if n := len(tree); n != 3 {
+		t.Fatalf("tree size mismatch: got=%d expected=3", n)
+	}
+}
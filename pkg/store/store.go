@@ -0,0 +1,144 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNotFound is returned when the key does not exist
+	ErrNotFound = errors.New("not found")
+)
+
+const ext = ".json"
+
+// Store is a key/value store which keeps each value as a JSON file
+// at <dir>/<bucket>/<key>.json
+type Store struct {
+	dir string
+	m   sync.Mutex
+}
+
+// Open creates dir if needed and returns new Store
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create `%s`: %s", dir, err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(bucket, key string) string {
+	return filepath.Join(s.dir, bucket, key+ext)
+}
+
+// Put stores v as JSON. The file is replaced atomically.
+func (s *Store) Put(bucket, key string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s/%s: %s", bucket, key, err)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	dir := filepath.Join(s.dir, bucket)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create `%s`: %s", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, "."+key)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write `%s`: %s", f.Name(), err)
+	}
+	// the content must be on disk before the rename, or a crash may leave
+	// the file empty
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to sync `%s`: %s", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close `%s`: %s", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), s.path(bucket, key)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to rename `%s`: %s", f.Name(), err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and removals in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open `%s`: %s", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync `%s`: %s", dir, err)
+	}
+	return nil
+}
+
+// Get decodes the value of key into v
+func (s *Store) Get(bucket, key string, v interface{}) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	b, err := ioutil.ReadFile(s.path(bucket, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to decode %s/%s: %s", bucket, key, err)
+	}
+	return nil
+}
+
+// Delete removes key. Deleting missing key is not an error.
+func (s *Store) Delete(bucket, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := os.Remove(s.path(bucket, key)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Join(s.dir, bucket))
+}
+
+// Keys returns sorted keys in bucket
+func (s *Store) Keys(bucket string) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, bucket))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	keys := []string{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(name, ext))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
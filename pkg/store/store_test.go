@@ -0,0 +1,57 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type value struct {
+	Name  string
+	Count int
+}
+
+func TestPutGetDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	for _, k := range []string{"b", "a"} {
+		if err := s.Put("values", k, &value{Name: k, Count: 1}); err != nil {
+			t.Fatalf("failed to put %s: %s", k, err)
+		}
+	}
+	if err := s.Put("values", "a", &value{Name: "a", Count: 2}); err != nil {
+		t.Fatalf("failed to overwrite: %s", err)
+	}
+	keys, err := s.Keys("values")
+	if err != nil {
+		t.Fatalf("failed to list keys: %s", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatalf("keys mismatch: got=%v", keys)
+	}
+	var v value
+	if err := s.Get("values", "a", &v); err != nil {
+		t.Fatalf("failed to get: %s", err)
+	}
+	if v != (value{Name: "a", Count: 2}) {
+		t.Fatalf("value mismatch: got=%+v", v)
+	}
+	if err := s.Delete("values", "a"); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	if err := s.Get("values", "a", &v); err != ErrNotFound {
+		t.Fatalf("error not returned: got=%v, expected=%s", err, ErrNotFound)
+	}
+	keys, _ = s.Keys("empty")
+	if len(keys) != 0 {
+		t.Fatalf("keys of missing bucket: got=%v", keys)
+	}
+}
@@ -0,0 +1,196 @@
+package gj
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultQueue is the queue of processes which do not specify one
+const DefaultQueue = "default"
+
+// Queue is a named queue of runs waiting for the pool. Runs in a queue
+// with higher priority start first, and at most Limit runs of the queue
+// execute at once (0 is unlimited).
+type Queue struct {
+	Name     string `json:"name"`
+	Limit    int    `json:"limit"`
+	Priority int    `json:"priority"`
+
+	running int
+}
+
+// ParseQueue parses a queue definition like "name:limit:priority".
+// limit and priority are optional.
+func ParseQueue(s string) (*Queue, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid queue: %s", s)
+	}
+	q := &Queue{Name: parts[0]}
+	var err error
+	if len(parts) > 1 {
+		if q.Limit, err = strconv.Atoi(parts[1]); err != nil || q.Limit < 0 {
+			return nil, fmt.Errorf("invalid queue limit: %s", s)
+		}
+	}
+	if len(parts) > 2 {
+		if q.Priority, err = strconv.Atoi(parts[2]); err != nil {
+			return nil, fmt.Errorf("invalid queue priority: %s", s)
+		}
+	}
+	return q, nil
+}
+
+// ticket is a run waiting for or holding a slot of the pool
+type ticket struct {
+	queue    *Queue
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	granted  bool
+}
+
+// Pool limits runs executing at once
+type Pool struct {
+	m       sync.Mutex
+	max     int
+	running int
+	queues  map[string]*Queue
+	waiting []*ticket
+	seq     uint64
+}
+
+// NewPool returns a pool which executes at most max runs at once
+// (0 is unlimited). The default queue is added unless queues has it.
+func NewPool(max int, queues []*Queue) *Pool {
+	p := &Pool{max: max, queues: map[string]*Queue{}}
+	for _, q := range queues {
+		p.queues[q.Name] = q
+	}
+	if _, ok := p.queues[DefaultQueue]; !ok {
+		p.queues[DefaultQueue] = &Queue{Name: DefaultQueue}
+	}
+	return p
+}
+
+// HasQueue returns true if the queue name exists. An empty name is the
+// default queue.
+func (p *Pool) HasQueue(name string) bool {
+	if name == "" {
+		return true
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	_, ok := p.queues[name]
+	return ok
+}
+
+// enqueue adds a run to the queue. Its ready channel is closed when the
+// run can execute.
+func (p *Pool) enqueue(queue string, priority int) *ticket {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if queue == "" {
+		queue = DefaultQueue
+	}
+	q, ok := p.queues[queue]
+	if !ok {
+		log.Printf("queue %s not found, using %s", queue, DefaultQueue)
+		q = p.queues[DefaultQueue]
+	}
+	p.seq++
+	t := &ticket{queue: q, priority: priority, seq: p.seq, ready: make(chan struct{})}
+	p.waiting = append(p.waiting, t)
+	p.sort()
+	p.dispatch()
+	return t
+}
+
+// release returns the slot of t, or removes t from the queue if it is waiting
+func (p *Pool) release(t *ticket) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if t.granted {
+		t.granted = false
+		p.running--
+		t.queue.running--
+	} else {
+		for i, w := range p.waiting {
+			if w == t {
+				p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	p.dispatch()
+}
+
+// position returns the 1-based position of t among waiting runs, or 0 if
+// it is not waiting
+func (p *Pool) position(t *ticket) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for i, w := range p.waiting {
+		if w == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// sort orders waiting runs by queue priority, run priority and arrival.
+// It must be called with p.m held.
+func (p *Pool) sort() {
+	sort.SliceStable(p.waiting, func(i, j int) bool {
+		a, b := p.waiting[i], p.waiting[j]
+		if a.queue.Priority != b.queue.Priority {
+			return a.queue.Priority > b.queue.Priority
+		}
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.seq < b.seq
+	})
+}
+
+// dispatch grants slots to waiting runs in order. It must be called with p.m held.
+func (p *Pool) dispatch() {
+	waiting := p.waiting[:0]
+	for _, t := range p.waiting {
+		full := p.max > 0 && p.running >= p.max
+		if full || (t.queue.Limit > 0 && t.queue.running >= t.queue.Limit) {
+			waiting = append(waiting, t)
+			continue
+		}
+		t.granted = true
+		p.running++
+		t.queue.running++
+		close(t.ready)
+	}
+	p.waiting = waiting
+}
+
+// QueueViewModel is the state of a queue
+type QueueViewModel struct {
+	Queue
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+}
+
+// ViewModels returns the states of the queues
+func (p *Pool) ViewModels() map[string]*QueueViewModel {
+	p.m.Lock()
+	defer p.m.Unlock()
+	models := map[string]*QueueViewModel{}
+	for name, q := range p.queues {
+		models[name] = &QueueViewModel{Queue: *q, Running: q.running}
+	}
+	for _, t := range p.waiting {
+		models[t.queue.Name].Waiting++
+	}
+	return models
+}
@@ -0,0 +1,98 @@
+package gj
+
+import (
+	"testing"
+)
+
+func granted(t *ticket) bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPoolOrder(t *testing.T) {
+	p := NewPool(1, []*Queue{{Name: "low"}, {Name: "high", Priority: 1}})
+	held := p.enqueue("", 0)
+	tickets := []struct {
+		queue    string
+		priority int
+		position int
+	}{
+		{"low", 0, 5},
+		{"high", 0, 1},
+		{"", 5, 3},
+		{"", 5, 4},
+		{"high", -1, 2},
+	}
+	ts := []*ticket{}
+	for _, c := range tickets {
+		ts = append(ts, p.enqueue(c.queue, c.priority))
+	}
+	for i, c := range tickets {
+		if n := p.position(ts[i]); n != c.position {
+			t.Errorf("position mismatch: queue=%s priority=%d, got=%d, expected=%d", c.queue, c.priority, n, c.position)
+		}
+	}
+	// slots are granted in order of positions
+	prev := held
+	for n := 1; n <= len(tickets); n++ {
+		p.release(prev)
+		for i, c := range tickets {
+			if c.position == n {
+				if !granted(ts[i]) {
+					t.Fatalf("ticket at %d not granted", n)
+				}
+				prev = ts[i]
+			} else if c.position > n && granted(ts[i]) {
+				t.Fatalf("ticket at %d granted before %d", c.position, n)
+			}
+		}
+	}
+}
+
+func TestPoolLimits(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		max      int
+		limit    int
+		queues   []string
+		expected []bool
+	}{
+		{"unlimited", 0, 0, []string{"batch", "batch", "batch"}, []bool{true, true, true}},
+		{"pool", 2, 0, []string{"batch", "", "batch"}, []bool{true, true, false}},
+		{"queue", 0, 2, []string{"batch", "batch", "batch"}, []bool{true, true, false}},
+		{"other queue", 0, 1, []string{"batch", "batch", ""}, []bool{true, false, true}},
+		{"pool under queue", 1, 2, []string{"batch", "batch"}, []bool{true, false}},
+	} {
+		p := NewPool(c.max, []*Queue{{Name: "batch", Limit: c.limit}})
+		for i, q := range c.queues {
+			if g := granted(p.enqueue(q, 0)); g != c.expected[i] {
+				t.Errorf("%s: ticket %d granted: got=%v, expected=%v", c.name, i, g, c.expected[i])
+			}
+		}
+	}
+}
+
+func TestPoolReleaseWaiting(t *testing.T) {
+	p := NewPool(1, nil)
+	held := p.enqueue("", 0)
+	cancelled := p.enqueue("", 0)
+	next := p.enqueue("", 0)
+	p.release(cancelled)
+	if n := p.position(next); n != 1 {
+		t.Fatalf("position mismatch: got=%d, expected=1", n)
+	}
+	if n := p.position(cancelled); n != 0 {
+		t.Fatalf("released ticket still waiting at %d", n)
+	}
+	p.release(held)
+	if granted(cancelled) || !granted(next) {
+		t.Fatalf("grants mismatch: released=%v, next=%v", granted(cancelled), granted(next))
+	}
+	if p.running != 1 {
+		t.Fatalf("running mismatch: got=%d, expected=1", p.running)
+	}
+}
@@ -1,16 +1,28 @@
 package gj
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/yoru9zine/gj/pkg/cgroup"
+	"github.com/yoru9zine/gj/pkg/execute"
 	"github.com/yoru9zine/gj/pkg/id"
 )
 
 var (
 	ErrProcessNotFound = errors.New("process not found")
 	ErrNotUniq         = errors.New("multiple process matched")
+	ErrNotRunning      = errors.New("process not running")
+	ErrAlreadyStarted  = errors.New("process already started")
+	ErrStopped         = errors.New("process stopped")
+	ErrNotPTY          = errors.New("process has no pty")
+	ErrRunNotFound     = errors.New("run not found")
+	ErrActive          = errors.New("process is active")
 )
 
 type Processes map[string]*Process
@@ -45,80 +57,659 @@ type Process struct {
 	ID       string
 	Name     string
 	Dir      string
+	Env      Env
 	Commands []*Command
-	Running  bool
-	Finished bool
 	PTY      bool
-	output   *bytes.Buffer
+	LogDir   string
+	// Schedule is the ID of the schedule which created the process
+	Schedule string
+	// EnvFiles are dotenv files merged under Env. The server environment
+	// is inherited unless InheritEnv is false.
+	EnvFiles   []string
+	InheritEnv bool
+	// Rows and Cols are the window size of the pty. Resize updates them
+	// so that following commands start with the latest size.
+	Rows uint16
+	Cols uint16
+	// Parallelism limits commands running at once. 0 is unlimited.
+	Parallelism int
+	// Queue is the name of the queue where runs wait for the pool, and
+	// runs with higher Priority start first in the queue.
+	Queue    string
+	Priority int
+	Limits   Limits
+	Log      LogConfig
+	// User and Group are the identity which commands run as. They must be
+	// allowed by the server.
+	User  string
+	Group string
+	// Timeout limits a whole run and StepTimeout each command. Commands are
+	// sent SIGTERM on timeout and SIGKILL after KillGrace.
+	Timeout     time.Duration
+	StepTimeout time.Duration
+	KillGrace   time.Duration
+
+	// Runs are executions of the process. The last one is the latest.
+	// KeepRuns caps kept runs, and older runs are removed with their logs.
+	Runs     []*Run
+	KeepRuns int
+
+	// RestartPolicy restarts finished runs automatically. Restarts counts
+	// automatic restarts since the last manual start or stable run.
+	RestartPolicy RestartPolicy
+	Restarts      int
+	NextRestart   *time.Time
+	CrashLoop     bool
+
+	m            sync.Mutex
+	persist      func(*ProcessViewModel)
+	persistRun   func(id string, r *RunViewModel)
+	removeRun    func(id string, n int)
+	pool         *Pool
+	cgroups      *cgroup.Manager
+	identities   *Identities
+	restartTimer *time.Timer
+	// indexLogs saves search indexes of logs of finished runs
+	indexLogs bool
+}
+
+const (
+	defaultKillGrace = 10 * time.Second
+	defaultKeepRuns  = 100
+)
+
+// NewProcess returns a process whose first run is in created state
+func NewProcess() *Process {
+	return &Process{Runs: []*Run{newRun(1)}, InheritEnv: true}
+}
+
+// changed saves the process with its latest run. Older runs do not change
+// and are saved by addRun. It must be called with j.m held.
+func (j *Process) changed() {
+	if j.persist != nil {
+		j.persist(j.header())
+	}
+}
+
+// keepRuns returns the number of runs to keep, which is at least the crash
+// loop limit so that crashes in a row are counted
+func (j *Process) keepRuns() int {
+	n := j.KeepRuns
+	if n == 0 {
+		n = defaultKeepRuns
+	}
+	if l := j.RestartPolicy.crashLoopLimit(); n < l {
+		n = l
+	}
+	return n
+}
+
+// addRun saves the latest run, appends a new one after it and removes the
+// oldest runs over keepRuns. It must be called with j.m held.
+func (j *Process) addRun() *Run {
+	prev := j.latest()
+	if j.persistRun != nil {
+		j.persistRun(j.ID, prev.ViewModel())
+	}
+	r := newRun(prev.Number + 1)
+	j.Runs = append(j.Runs, r)
+	for len(j.Runs) > j.keepRuns() {
+		old := j.Runs[0]
+		j.Runs = j.Runs[1:]
+		if j.removeRun != nil {
+			j.removeRun(j.ID, old.Number)
+		}
+	}
+	return r
+}
+
+func (j *Process) killGrace() time.Duration {
+	if j.KillGrace == 0 {
+		return defaultKillGrace
+	}
+	return j.KillGrace
+}
+
+// latest returns the latest run. It must be called with j.m held.
+func (j *Process) latest() *Run {
+	return j.Runs[len(j.Runs)-1]
+}
+
+// findRun returns the run numbered n, or the latest run for 0
+func (j *Process) findRun(n int) (*Run, error) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	if n == 0 {
+		return j.latest(), nil
+	}
+	for _, r := range j.Runs {
+		if r.Number == n {
+			return r, nil
+		}
+	}
+	return nil, ErrRunNotFound
 }
 
+// Latest returns the state of the latest run and a channel closed when it finishes
+func (j *Process) Latest() (State, <-chan struct{}) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	r := j.latest()
+	return r.State, r.done
+}
+
+func (j *Process) markLost() {
+	j.m.Lock()
+	defer j.m.Unlock()
+	r := j.latest()
+	r.Error = "server stopped while the process was active"
+	if err := j.transit(r, StateLost); err != nil {
+		log.Printf("failed to mark process %s as lost: %s", j.ID, err)
+	}
+	close(r.done)
+}
+
+// Start queues the latest run and runs its commands in background
 func (j *Process) Start() error {
-	j.output = &bytes.Buffer{}
-	for _, cmd := range j.Commands {
-		_, stdout, stderr, c, err := cmd.Start(&CommandOption{PTY: j.PTY})
-		if err != nil {
-			return err
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.start(j.latest())
+}
+
+func (j *Process) start(r *Run) error {
+	if r.State != StateCreated {
+		return ErrAlreadyStarted
+	}
+	if err := j.transit(r, StateQueued); err != nil {
+		return err
+	}
+	r.Steps = make([]*StepStatus, len(j.Commands))
+	for i, c := range j.Commands {
+		r.Steps[i] = &StepStatus{Name: c.Step, State: StepPending}
+	}
+	go j.run(r)
+	return nil
+}
+
+// Restart starts a new run of the process and returns its number.
+// An active run is stopped first like Stop.
+func (j *Process) Restart(grace time.Duration) (int, error) {
+	for {
+		state, done := j.Latest()
+		if !state.Active() {
+			break
 		}
-		j.Running = true
-		if stdout != nil {
-			go io.Copy(j.output, stdout)
+		if err := j.Stop(grace); err != nil && err != ErrNotRunning {
+			return 0, err
 		}
-		if stderr != nil {
-			go io.Copy(j.output, stderr)
+		<-done
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+	r := j.latest()
+	if r.State.Active() {
+		return 0, ErrActive
+	}
+	j.cancelRestart()
+	j.Restarts = 0
+	j.CrashLoop = false
+	if r.State != StateCreated {
+		r = j.addRun()
+	}
+	if err := j.start(r); err != nil {
+		return 0, err
+	}
+	return r.Number, nil
+}
+
+// Signal sends sig to the process groups of the running commands
+func (j *Process) Signal(sig syscall.Signal) error {
+	j.m.Lock()
+	r := j.latest()
+	ps := r.processes()
+	if len(ps) > 0 {
+		r.signaled = true
+	}
+	j.m.Unlock()
+	if len(ps) == 0 {
+		return ErrNotRunning
+	}
+	var err error
+	for _, p := range ps {
+		if e := p.Signal(sig); e != nil {
+			err = e
 		}
+	}
+	return err
+}
 
-		err = c.Wait()
-		j.Running = false
-		j.Finished = true
-		if err != nil {
-			return err
+// Stop sends SIGTERM to the running commands and SIGKILL if it is still
+// alive after grace. Remaining commands are not started. A scheduled
+// automatic restart is cancelled.
+func (j *Process) Stop(grace time.Duration) error {
+	j.m.Lock()
+	r := j.latest()
+	if !r.State.Active() {
+		cancelled := j.cancelRestart()
+		j.m.Unlock()
+		if cancelled {
+			return nil
 		}
+		return ErrNotRunning
+	}
+	r.stop()
+	ps := r.processes()
+	j.m.Unlock()
+	return j.terminateAll(r, ps, grace)
+}
+
+// terminateAll terminates ps at once like terminate
+func (j *Process) terminateAll(r *Run, ps []*execute.Process, grace time.Duration) error {
+	errs := make(chan error, len(ps))
+	for _, p := range ps {
+		go func(p *execute.Process) {
+			errs <- j.terminate(r, p, grace)
+		}(p)
+	}
+	var err error
+	for range ps {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// terminate sends SIGTERM to p and SIGKILL if it is still alive after grace
+func (j *Process) terminate(r *Run, p *execute.Process, grace time.Duration) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		if err == syscall.ESRCH {
+			return nil
+		}
+		return err
+	}
+	select {
+	case <-p.Exited():
+		return nil
+	case <-time.After(grace):
+	}
+	j.m.Lock()
+	r.killed = true
+	j.m.Unlock()
+	if err := p.Signal(syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
 	}
 	return nil
 }
 
+// WriteLog writes stdout and stderr recorded in the log of run n to w.
+// n is 0 for the latest run. opt may be nil.
+func (j *Process) WriteLog(w io.Writer, n int, opt *LogOption) error {
+	r, err := j.findRun(n)
+	if err != nil {
+		return err
+	}
+	j.m.Lock()
+	state := r.State
+	j.m.Unlock()
+	logOpt := j.logOption(r)
+	if state == StateCreated || state == StateQueued || !execute.LogExists(logOpt) {
+		return nil
+	}
+	return execute.ReadProcessLog(logOpt, newLogPrinter(w, opt).print)
+}
+
+// FollowLog writes output like WriteLog and keeps writing new output until
+// the run finishes or cancel is closed
+func (j *Process) FollowLog(w io.Writer, n int, cancel <-chan struct{}, opt *LogOption) error {
+	r, err := j.findRun(n)
+	if err != nil {
+		return err
+	}
+	for {
+		j.m.Lock()
+		state := r.State
+		j.m.Unlock()
+		if state == StateCreated {
+			return nil
+		}
+		if state != StateQueued {
+			break
+		}
+		select {
+		case <-cancel:
+			return nil
+		case <-r.done:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	logOpt := j.logOption(r)
+	if !execute.LogExists(logOpt) {
+		// the run failed before its log was created
+		return nil
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-r.done:
+		case <-cancel:
+		}
+		close(stop)
+	}()
+	return execute.FollowProcessLog(logOpt, stop, newLogPrinter(w, opt).print)
+}
+
+// WriteStdin copies r to stdin of the first running command and closes
+// stdin after that when closeStdin is true
+func (j *Process) WriteStdin(r io.Reader, closeStdin bool) error {
+	j.m.Lock()
+	p := j.latest().primary()
+	j.m.Unlock()
+	if p == nil {
+		return ErrNotRunning
+	}
+	if _, err := io.Copy(p.Stdin, r); err != nil {
+		return fmt.Errorf("failed to write stdin: %s", err)
+	}
+	if closeStdin {
+		return p.CloseStdin()
+	}
+	return nil
+}
+
+// Resize changes the window size of the pty
+func (j *Process) Resize(rows, cols uint16) error {
+	if !j.PTY {
+		return ErrNotPTY
+	}
+	j.m.Lock()
+	r := j.latest()
+	if r.State.Finished() {
+		j.m.Unlock()
+		return ErrNotRunning
+	}
+	j.Rows, j.Cols = rows, cols
+	j.changed()
+	ps := r.processes()
+	j.m.Unlock()
+	var err error
+	for _, p := range ps {
+		if e := p.Resize(rows, cols); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Attach connects a terminal to the first running command in turn. Data received from
+// in is written to the pty and output is passed to out. It returns when in
+// is closed, out fails or the process finishes.
+func (j *Process) Attach(in <-chan []byte, out func([]byte) error) error {
+	if !j.PTY {
+		return ErrNotPTY
+	}
+	var last *execute.Process
+	for {
+		j.m.Lock()
+		r := j.latest()
+		p, state, done := r.primary(), r.State, r.done
+		j.m.Unlock()
+		if !state.Active() {
+			if state == StateCreated {
+				return ErrNotRunning
+			}
+			return nil
+		}
+		if p == nil || p == last {
+			// between commands
+			select {
+			case _, ok := <-in:
+				if !ok {
+					return nil
+				}
+			case <-done:
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		last = p
+		if detached, err := attach(p, in, out); detached || err != nil {
+			return err
+		}
+	}
+}
+
+func attach(p *execute.Process, in <-chan []byte, out func([]byte) error) (bool, error) {
+	output, detach := p.Attach()
+	defer detach()
+	for {
+		select {
+		case b, ok := <-output:
+			if !ok {
+				return false, nil
+			}
+			if err := out(b); err != nil {
+				return true, err
+			}
+		case b, ok := <-in:
+			if !ok {
+				return true, nil
+			}
+			if _, err := p.Stdin.Write(b); err != nil {
+				log.Printf("failed to write to pty: %s", err)
+			}
+		}
+	}
+}
+
 func (j *Process) ViewModel() *ProcessViewModel {
-	cmds := [][]string{}
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.viewModel()
+}
+
+func (j *Process) viewModel() *ProcessViewModel {
+	pvm := j.header()
+	for _, r := range j.Runs[:len(j.Runs)-1] {
+		pvm.Runs = append(pvm.Runs, r.ViewModel())
+	}
+	latest := pvm.RunViewModel
+	pvm.Runs = append(pvm.Runs, &latest)
+	return pvm
+}
+
+// header returns the view model of the process with the latest run only
+func (j *Process) header() *ProcessViewModel {
+	cmds := []CommandSpec{}
 	for _, c := range j.Commands {
-		cmd := []string{c.Name}
-		cmd = append(cmd, c.Args...)
-		cmds = append(cmds, cmd)
+		cmds = append(cmds, c.spec())
+	}
+	var inherit *bool
+	if !j.InheritEnv {
+		inherit = new(bool)
+	}
+	position := 0
+	if t := j.latest().ticket; t != nil {
+		position = j.pool.position(t)
 	}
 	return &ProcessViewModel{
-		ID:       j.ID,
-		Name:     j.Name,
-		Dir:      j.Dir,
-		Commands: cmds,
-		Running:  j.Running,
-		Finished: j.Finished,
-		PTY:      j.PTY,
+		ID:            j.ID,
+		Name:          j.Name,
+		Dir:           j.Dir,
+		Env:           j.Env,
+		Schedule:      j.Schedule,
+		EnvFiles:      j.EnvFiles,
+		InheritEnv:    inherit,
+		Commands:      cmds,
+		PTY:           j.PTY,
+		Rows:          j.Rows,
+		Cols:          j.Cols,
+		Parallelism:   j.Parallelism,
+		Queue:         j.Queue,
+		Priority:      j.Priority,
+		Limits:        j.Limits,
+		Enforced:      j.Limits.enforced(j.cgroups != nil),
+		Log:           j.Log,
+		User:          j.User,
+		Group:         j.Group,
+		QueuePosition: position,
+		Timeout:       Duration(j.Timeout),
+		StepTimeout:   Duration(j.StepTimeout),
+		KillGrace:     Duration(j.KillGrace),
+		Restart:       j.RestartPolicy,
+		Restarts:      j.Restarts,
+		NextRestart:   j.NextRestart,
+		CrashLoop:     j.CrashLoop,
+		KeepRuns:      j.KeepRuns,
+		RunViewModel:  *j.latest().ViewModel(),
+	}
+}
+
+// RunViewModels returns view models of all runs
+func (j *Process) RunViewModels() []*RunViewModel {
+	j.m.Lock()
+	defer j.m.Unlock()
+	runs := []*RunViewModel{}
+	for _, r := range j.Runs {
+		runs = append(runs, r.ViewModel())
+	}
+	return runs
+}
+
+// RunViewModel returns the view model of run n, or the latest run for 0
+func (j *Process) RunViewModel(n int) (*RunViewModel, error) {
+	r, err := j.findRun(n)
+	if err != nil {
+		return nil, err
 	}
+	j.m.Lock()
+	defer j.m.Unlock()
+	return r.ViewModel(), nil
 }
 
 type ProcessViewModel struct {
-	ID       string     `json:"id"`
-	Name     string     `json:"name"`
-	Dir      string     `json:"dir"`
-	Commands [][]string `json:"commands"`
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Dir      string        `json:"dir"`
+	Env      Env           `json:"env"`
+	Commands []CommandSpec `json:"commands"`
+	PTY      bool          `json:"pty"`
+	Rows     uint16        `json:"rows,omitempty"`
+	Cols     uint16        `json:"cols,omitempty"`
+
+	Parallelism int    `json:"parallelism,omitempty"`
+	Schedule    string `json:"schedule,omitempty"`
+
+	Queue    string    `json:"queue,omitempty"`
+	Priority int       `json:"priority,omitempty"`
+	Limits   Limits    `json:"limits"`
+	Log      LogConfig `json:"log"`
+	// Enforced maps limits in effect to cgroup or rlimit, which applies them
+	Enforced map[string]string `json:"enforced_limits,omitempty"`
+	// QueuePosition is the 1-based position in the pool while queued
+	QueuePosition int `json:"queue_position,omitempty"`
+
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// EnvFiles are paths of dotenv files relative to Dir
+	EnvFiles   []string `json:"env_file,omitempty"`
+	InheritEnv *bool    `json:"inherit_env,omitempty"`
+
+	Timeout     Duration `json:"timeout,omitempty"`
+	StepTimeout Duration `json:"step_timeout,omitempty"`
+	KillGrace   Duration `json:"kill_grace,omitempty"`
+
+	Restart     RestartPolicy `json:"restart"`
+	Restarts    int           `json:"restarts"`
+	NextRestart *time.Time    `json:"next_restart_at,omitempty"`
+	CrashLoop   bool          `json:"crash_loop,omitempty"`
 
-	Running  bool `json:"running"`
-	Finished bool `json:"finished"`
-	PTY      bool `json:"pty"`
+	KeepRuns int `json:"keep_runs,omitempty"`
+
+	// RunViewModel is the latest run
+	RunViewModel
+	Runs []*RunViewModel `json:"runs,omitempty"`
 }
 
 func (j *ProcessViewModel) Process() *Process {
 	cmds := []*Command{}
 	for _, c := range j.Commands {
-		cmds = append(cmds, &Command{
-			Name: c[0],
-			Args: c[1:],
-		})
-	}
-	return &Process{
-		ID:       j.ID,
-		Name:     j.Name,
-		Dir:      j.Dir,
-		Commands: cmds,
-		PTY:      j.PTY,
+		cmds = append(cmds, c.command())
+	}
+	p := NewProcess()
+	p.ID = j.ID
+	p.Name = j.Name
+	p.Dir = j.Dir
+	p.Env = j.Env
+	p.Schedule = j.Schedule
+	p.EnvFiles = j.EnvFiles
+	p.InheritEnv = j.InheritEnv == nil || *j.InheritEnv
+	p.Commands = cmds
+	p.PTY = j.PTY
+	p.Rows = j.Rows
+	p.Cols = j.Cols
+	p.Parallelism = j.Parallelism
+	p.Queue = j.Queue
+	p.Priority = j.Priority
+	p.Limits = j.Limits
+	p.Log = j.Log
+	p.User = j.User
+	p.Group = j.Group
+	p.Timeout = time.Duration(j.Timeout)
+	p.StepTimeout = time.Duration(j.StepTimeout)
+	p.KillGrace = time.Duration(j.KillGrace)
+	p.RestartPolicy = j.Restart
+	p.KeepRuns = j.KeepRuns
+	return p
+}
+
+// Validate checks the process definition given by a client
+func (j *ProcessViewModel) Validate() error {
+	if len(j.Commands) == 0 {
+		return fmt.Errorf("no commands")
+	}
+	for _, c := range j.Commands {
+		if len(c.Command) == 0 {
+			return fmt.Errorf("empty command")
+		}
+	}
+	if _, err := dependencies(j.Process().Commands); err != nil {
+		return err
+	}
+	if j.Parallelism < 0 {
+		return fmt.Errorf("parallelism must not be negative")
+	}
+	if err := j.Limits.validate(); err != nil {
+		return err
+	}
+	if err := j.Log.validate(); err != nil {
+		return err
+	}
+	if j.Timeout < 0 || j.StepTimeout < 0 || j.KillGrace < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if j.KeepRuns < 0 {
+		return fmt.Errorf("keep_runs must not be negative")
+	}
+	return j.Restart.validate()
+}
+
+// restore returns the process saved as j including its runs
+func (j *ProcessViewModel) restore() *Process {
+	p := j.Process()
+	if len(j.Runs) == 0 {
+		return p
+	}
+	p.Runs = nil
+	for _, r := range j.Runs {
+		p.Runs = append(p.Runs, r.restore())
 	}
+	p.Restarts = j.Restarts
+	p.NextRestart = j.NextRestart
+	p.CrashLoop = j.CrashLoop
+	return p
 }
@@ -0,0 +1,98 @@
+package gj
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestProcess returns a process running commands with logs under dir
+func newTestProcess(t *testing.T, dir, id string, commands ...[]string) *Process {
+	pvm := &ProcessViewModel{ID: id}
+	for _, cmd := range commands {
+		pvm.Commands = append(pvm.Commands, CommandSpec{Command: cmd, sequence: true})
+	}
+	if err := pvm.Validate(); err != nil {
+		t.Fatalf("invalid process: %s", err)
+	}
+	j := pvm.Process()
+	j.LogDir = dir
+	return j
+}
+
+// waitFor polls cond until it returns true
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKillGrace(t *testing.T) {
+	for _, c := range []struct {
+		killGrace time.Duration
+		expected  time.Duration
+	}{
+		{0, defaultKillGrace},
+		{time.Second, time.Second},
+	} {
+		j := &Process{KillGrace: c.killGrace}
+		if g := j.killGrace(); g != c.expected {
+			t.Errorf("kill grace mismatch: kill_grace=%s, got=%s, expected=%s", c.killGrace, g, c.expected)
+		}
+	}
+}
+
+func TestQueuedStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	pool := NewPool(1, nil)
+	running := newTestProcess(t, dir, "running", []string{"sleep", "5"})
+	queued := newTestProcess(t, dir, "queued", []string{"true"})
+	running.pool, queued.pool = pool, pool
+	if err := running.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	waitFor(t, "running", func() bool { return running.ViewModel().State == StateRunning })
+	if err := queued.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	if err := queued.Start(); err != ErrAlreadyStarted {
+		t.Errorf("started twice: got=%v, expected=%s", err, ErrAlreadyStarted)
+	}
+	waitFor(t, "queue position", func() bool { return queued.ViewModel().QueuePosition == 1 })
+	if state := queued.ViewModel().State; state != StateQueued {
+		t.Fatalf("state mismatch while waiting: got=%s, expected=%s", state, StateQueued)
+	}
+
+	// the queued run starts once the slot is released
+	if err := running.Stop(time.Second); err != nil {
+		t.Fatalf("failed to stop: %s", err)
+	}
+	_, done := queued.Latest()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("queued run did not finish")
+	}
+	pvm := queued.ViewModel()
+	if pvm.QueuePosition != 0 {
+		t.Errorf("queue position after start: got=%d, expected=0", pvm.QueuePosition)
+	}
+	states := []State{}
+	for _, tr := range pvm.Transitions {
+		states = append(states, tr.State)
+	}
+	expected := []State{StateCreated, StateQueued, StateRunning, StateSucceeded}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("transitions mismatch: got=%v, expected=%v", states, expected)
+	}
+}
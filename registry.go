@@ -0,0 +1,295 @@
+package gj
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/cgroup"
+	"github.com/yoru9zine/gj/pkg/store"
+)
+
+const (
+	procBucket = "procs"
+	// runBucket keeps runs other than the latest one by "<process ID>.<run>"
+	runBucket = "runs"
+)
+
+// Registry holds processes and persists their definitions and states
+type Registry struct {
+	m       sync.RWMutex
+	procs   Processes
+	store   *store.Store
+	writer  *storeWriter
+	logDir  string
+	pool    *Pool
+	cgroups *cgroup.Manager
+	// identities are users and groups which processes may run as
+	identities *Identities
+	// indexLogs saves search indexes of logs
+	indexLogs bool
+}
+
+// NewRegistry loads processes saved in s. Processes which were active when
+// the server stopped are marked as lost. Runs wait for pool before starting
+// commands, and runs with limits execute in cgroups of cgroups if it is not nil.
+// Commands may run as users and groups of identities only. Search indexes
+// of logs are saved when runs finish or are searched if indexLogs is true.
+func NewRegistry(s *store.Store, logDir string, pool *Pool, cgroups *cgroup.Manager, identities *Identities, indexLogs bool) (*Registry, error) {
+	r := &Registry{
+		procs:      Processes{},
+		store:      s,
+		writer:     newStoreWriter(s),
+		logDir:     logDir,
+		pool:       pool,
+		cgroups:    cgroups,
+		identities: identities,
+		indexLogs:  indexLogs,
+	}
+	keys, err := s.Keys(procBucket)
+	if err != nil {
+		return nil, err
+	}
+	runs, err := r.loadRuns()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		var pvm ProcessViewModel
+		if err := s.Get(procBucket, k, &pvm); err != nil {
+			log.Printf("failed to load process %s: %s", k, err)
+			continue
+		}
+		saved := len(pvm.Runs) > 0
+		if !saved {
+			latest := pvm.RunViewModel
+			pvm.Runs = append(runs[pvm.ID], &latest)
+		}
+		proc := pvm.restore()
+		r.attach(proc)
+		if saved {
+			// saved with all runs by older versions
+			r.migrate(proc)
+		}
+		state, _ := proc.Latest()
+		if state.Active() {
+			proc.markLost()
+		}
+		proc.m.Lock()
+		if state.Active() || proc.NextRestart != nil {
+			proc.scheduleRestart()
+		}
+		proc.m.Unlock()
+		r.procs[proc.ID] = proc
+	}
+	return r, nil
+}
+
+func (r *Registry) attach(proc *Process) {
+	proc.LogDir = r.logDir
+	proc.persist = r.save
+	proc.persistRun = r.saveRun
+	proc.removeRun = r.removeRun
+	proc.pool = r.pool
+	proc.cgroups = r.cgroups
+	proc.identities = r.identities
+	proc.indexLogs = r.indexLogs
+}
+
+// save saves pvm in the background. It is called with the lock of the
+// process held.
+func (r *Registry) save(pvm *ProcessViewModel) {
+	r.writer.put(procBucket, pvm.ID, pvm)
+}
+
+func runKey(id string, n int) string {
+	return fmt.Sprintf("%s.%d", id, n)
+}
+
+func (r *Registry) saveRun(id string, rvm *RunViewModel) {
+	r.writer.put(runBucket, runKey(id, rvm.Run), rvm)
+}
+
+// removeRun deletes run n of process id and its log
+func (r *Registry) removeRun(id string, n int) {
+	r.writer.remove(runBucket, runKey(id, n))
+	if err := os.RemoveAll(filepath.Join(r.logDir, id, strconv.Itoa(n))); err != nil {
+		log.Printf("failed to remove log of process %s run %d: %s", id, n, err)
+	}
+}
+
+// loadRuns returns saved runs by process ID in order of numbers
+func (r *Registry) loadRuns() (map[string][]*RunViewModel, error) {
+	keys, err := r.store.Keys(runBucket)
+	if err != nil {
+		return nil, err
+	}
+	runs := map[string][]*RunViewModel{}
+	for _, k := range keys {
+		i := strings.LastIndex(k, ".")
+		if i < 0 {
+			continue
+		}
+		rvm := &RunViewModel{}
+		if err := r.store.Get(runBucket, k, rvm); err != nil {
+			log.Printf("failed to load run %s: %s", k, err)
+			continue
+		}
+		runs[k[:i]] = append(runs[k[:i]], rvm)
+	}
+	for _, rs := range runs {
+		sort.Slice(rs, func(i, k int) bool { return rs[i].Run < rs[k].Run })
+	}
+	return runs, nil
+}
+
+// migrate saves proc loaded with all runs in the process record as runs
+// kept apart
+func (r *Registry) migrate(proc *Process) {
+	proc.m.Lock()
+	defer proc.m.Unlock()
+	for _, run := range proc.Runs[:len(proc.Runs)-1] {
+		r.saveRun(proc.ID, run.ViewModel())
+	}
+	proc.changed()
+}
+
+// Add registers and saves proc
+func (r *Registry) Add(proc *Process) error {
+	r.attach(proc)
+	proc.m.Lock()
+	pvm := proc.header()
+	proc.m.Unlock()
+	if err := r.store.Put(procBucket, proc.ID, pvm); err != nil {
+		return err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.procs[proc.ID] = proc
+	return nil
+}
+
+// Find returns the process whose ID starts with prefix
+func (r *Registry) Find(prefix string) (*Process, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.procs.Find(prefix)
+}
+
+func (r *Registry) ViewModels() map[string]*ProcessViewModel {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.procs.ViewModels()
+}
+
+// Remove deletes proc and its logs. An active process is refused unless
+// force is true, in which case it is killed first.
+func (r *Registry) Remove(proc *Process, force bool) error {
+	state, done := proc.Latest()
+	if state.Active() {
+		if !force {
+			return ErrActive
+		}
+		if err := proc.Stop(0); err != nil && err != ErrNotRunning {
+			return err
+		}
+		<-done
+	}
+	proc.m.Lock()
+	proc.cancelRestart()
+	proc.persist = nil
+	proc.persistRun = nil
+	proc.removeRun = nil
+	older := []int{}
+	for _, run := range proc.Runs[:len(proc.Runs)-1] {
+		older = append(older, run.Number)
+	}
+	proc.m.Unlock()
+
+	r.m.Lock()
+	delete(r.procs, proc.ID)
+	r.m.Unlock()
+	// saves of proc made before must not recreate its records
+	r.writer.flush()
+	if err := r.store.Delete(procBucket, proc.ID); err != nil {
+		return err
+	}
+	for _, n := range older {
+		if err := r.store.Delete(runBucket, runKey(proc.ID, n)); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(r.logDir, proc.ID)); err != nil {
+		return fmt.Errorf("failed to remove log: %s", err)
+	}
+	return nil
+}
+
+// Prune removes finished processes whose last transition is older than
+// olderThan and whose state matches one of states. "finished" matches
+// every terminal state.
+func (r *Registry) Prune(olderThan time.Duration, states []State) ([]string, error) {
+	r.m.RLock()
+	targets := []*Process{}
+	for _, proc := range r.procs {
+		proc.m.Lock()
+		run := proc.latest()
+		state := run.State
+		last := run.Transitions[len(run.Transitions)-1].At
+		proc.m.Unlock()
+		if !state.Finished() || time.Since(last) < olderThan || !matchState(state, states) {
+			continue
+		}
+		targets = append(targets, proc)
+	}
+	r.m.RUnlock()
+	removed := []string{}
+	for _, proc := range targets {
+		err := r.Remove(proc, false)
+		if err == ErrActive {
+			// restarted since it was selected
+			continue
+		}
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %s", proc.ID, err)
+		}
+		removed = append(removed, proc.ID)
+	}
+	return removed, nil
+}
+
+func matchState(state State, states []State) bool {
+	for _, s := range states {
+		if s == state || (s == "finished" && state.Finished()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAge parses positive duration like "90m" or "7d"
+func ParseAge(s string) (time.Duration, error) {
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		d = time.Duration(days * float64(24*time.Hour))
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", s)
+	}
+	return d, nil
+}
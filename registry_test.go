@@ -0,0 +1,125 @@
+package gj
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/store"
+)
+
+func TestParseAge(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		expected time.Duration
+		err      bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"10s", 10 * time.Second, false},
+		{"xd", 0, true},
+		{"7", 0, true},
+		{"0s", 0, true},
+		{"-1h", 0, true},
+		{"-2d", 0, true},
+		{"0d", 0, true},
+	} {
+		d, err := ParseAge(c.s)
+		if (err != nil) != c.err || d != c.expected {
+			t.Errorf("age mismatch: s=%s, got=%s %v, expected=%s", c.s, d, err, c.expected)
+		}
+	}
+}
+
+func TestMatchState(t *testing.T) {
+	for _, c := range []struct {
+		state    State
+		states   []State
+		expected bool
+	}{
+		{StateSucceeded, []State{"finished"}, true},
+		{StateFailed, []State{"finished"}, true},
+		{StateLost, []State{"finished"}, true},
+		{StateRunning, []State{"finished"}, false},
+		{StateCreated, []State{"finished"}, false},
+		{StateFailed, []State{StateSucceeded}, false},
+		{StateFailed, []State{StateSucceeded, StateFailed}, true},
+		{StateSucceeded, nil, false},
+	} {
+		if m := matchState(c.state, c.states); m != c.expected {
+			t.Errorf("match mismatch: state=%s, states=%v, got=%v", c.state, c.states, m)
+		}
+	}
+}
+
+func TestRunHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	logDir := filepath.Join(dir, "logs")
+	procs, err := NewRegistry(st, logDir, NewPool(0, nil), nil, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+	pvm := &ProcessViewModel{
+		ID:       "test",
+		Commands: []CommandSpec{{Command: []string{"true"}, sequence: true}},
+		KeepRuns: 2,
+		Restart:  RestartPolicy{CrashLoopLimit: 1},
+	}
+	proc := pvm.Process()
+	if err := procs.Add(proc); err != nil {
+		t.Fatalf("failed to add process: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := proc.Restart(0); err != nil {
+			t.Fatalf("failed to start run %d: %s", i+1, err)
+		}
+		_, done := proc.Latest()
+		<-done
+	}
+	numbers := func(p *Process) []int {
+		ns := []int{}
+		for _, r := range p.RunViewModels() {
+			ns = append(ns, r.Run)
+		}
+		return ns
+	}
+	if ns := numbers(proc); !reflect.DeepEqual(ns, []int{3, 4}) {
+		t.Fatalf("runs mismatch: got=%v", ns)
+	}
+	procs.writer.flush()
+	if keys, _ := st.Keys(runBucket); !reflect.DeepEqual(keys, []string{"test.3"}) {
+		t.Fatalf("saved runs mismatch: got=%v", keys)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(logDir, "test")); len(files) != 2 {
+		t.Fatalf("logs of removed runs are kept: %d", len(files))
+	}
+	loaded, err := NewRegistry(st, logDir, NewPool(0, nil), nil, nil, false)
+	if err != nil {
+		t.Fatalf("failed to load registry: %s", err)
+	}
+	proc, err = loaded.Find("test")
+	if err != nil {
+		t.Fatalf("failed to find process: %s", err)
+	}
+	if ns := numbers(proc); !reflect.DeepEqual(ns, []int{3, 4}) {
+		t.Fatalf("loaded runs mismatch: got=%v", ns)
+	}
+	if _, err := proc.findRun(1); err != ErrRunNotFound {
+		t.Fatalf("removed run found: %v", err)
+	}
+	if r, err := proc.findRun(3); err != nil || r.State != StateSucceeded {
+		t.Fatalf("run 3 not loaded: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package gj
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Restart policies
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	defaultBackoff        = time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+	defaultMinUptime      = 10 * time.Second
+	defaultCrashLoopLimit = 5
+)
+
+// RestartPolicy decides whether a finished run is started again.
+// The delay before a restart doubles from Backoff for each run in a row
+// which finished within MinUptime, even successfully, up to MaxBackoff.
+// A run which fails within MinUptime is a crash, and CrashLoopLimit
+// crashes in a row stop restarting.
+type RestartPolicy struct {
+	Policy         string   `json:"policy"`
+	MaxRetries     int      `json:"max_retries,omitempty"`
+	Backoff        Duration `json:"backoff,omitempty"`
+	MaxBackoff     Duration `json:"max_backoff,omitempty"`
+	MinUptime      Duration `json:"min_uptime,omitempty"`
+	CrashLoopLimit int      `json:"crash_loop_limit,omitempty"`
+}
+
+func (p *RestartPolicy) validate() error {
+	switch p.Policy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return fmt.Errorf("unknown restart policy: %s", p.Policy)
+	}
+	if p.MaxRetries < 0 || p.CrashLoopLimit < 0 || p.Backoff < 0 || p.MaxBackoff < 0 || p.MinUptime < 0 {
+		return fmt.Errorf("restart policy values must not be negative")
+	}
+	return nil
+}
+
+func (p *RestartPolicy) backoff() time.Duration {
+	if p.Backoff == 0 {
+		return defaultBackoff
+	}
+	return time.Duration(p.Backoff)
+}
+
+func (p *RestartPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff == 0 {
+		return defaultMaxBackoff
+	}
+	return time.Duration(p.MaxBackoff)
+}
+
+func (p *RestartPolicy) minUptime() time.Duration {
+	if p.MinUptime == 0 {
+		return defaultMinUptime
+	}
+	return time.Duration(p.MinUptime)
+}
+
+func (p *RestartPolicy) crashLoopLimit() int {
+	if p.CrashLoopLimit == 0 {
+		return defaultCrashLoopLimit
+	}
+	return p.CrashLoopLimit
+}
+
+// restartable returns true if the policy restarts a run finished in state
+func (p *RestartPolicy) restartable(state State) bool {
+	switch state {
+	case StateSucceeded:
+		return p.Policy == RestartAlways
+	case StateFailed, StateTimedOut, StateOOMKilled, StateLost:
+		return p.Policy == RestartAlways || p.Policy == RestartOnFailure
+	}
+	// stopped or killed by user
+	return false
+}
+
+// quick returns true if r finished within min uptime, even successfully
+func (p *RestartPolicy) quick(r *Run) bool {
+	var started time.Time
+	for _, t := range r.Transitions {
+		if t.State == StateRunning {
+			started = t.At
+		}
+	}
+	end := r.Transitions[len(r.Transitions)-1].At
+	return started.IsZero() || end.Sub(started) < p.minUptime()
+}
+
+// crashed returns true if r failed within min uptime
+func (p *RestartPolicy) crashed(r *Run) bool {
+	return r.State != StateSucceeded && p.quick(r)
+}
+
+// crashes returns the number of crashed runs in a row at the end of runs
+func (p *RestartPolicy) crashes(runs []*Run) int {
+	n := 0
+	for i := len(runs) - 1; i >= 0 && p.crashed(runs[i]); i-- {
+		n++
+	}
+	return n
+}
+
+// attempt returns the zero-based attempt of the next restart, which is
+// the number of quick runs in a row at the end of runs but the first
+func (p *RestartPolicy) attempt(runs []*Run) int {
+	n := 0
+	for i := len(runs) - 1; i >= 0 && p.quick(runs[i]); i-- {
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return n - 1
+}
+
+// delay returns the backoff before restart attempt, which doubles from
+// the backoff of attempt 0
+func (p *RestartPolicy) delay(attempt int) time.Duration {
+	d := p.backoff()
+	for i := 0; i < attempt; i++ {
+		d *= 2
+		if d >= p.maxBackoff() {
+			return p.maxBackoff()
+		}
+	}
+	return d
+}
+
+// scheduleRestart starts a timer to restart the finished latest run
+// according to the restart policy. It must be called with j.m held.
+func (j *Process) scheduleRestart() {
+	r := j.latest()
+	if !r.State.Finished() || !j.RestartPolicy.restartable(r.State) {
+		return
+	}
+	if !j.RestartPolicy.quick(r) {
+		// retries are counted again after a stable run
+		j.Restarts = 0
+	}
+	if j.RestartPolicy.MaxRetries > 0 && j.Restarts >= j.RestartPolicy.MaxRetries {
+		log.Printf("process %s reached max retries %d", j.ID, j.RestartPolicy.MaxRetries)
+		return
+	}
+	crashes := j.RestartPolicy.crashes(j.Runs)
+	if crashes >= j.RestartPolicy.crashLoopLimit() {
+		log.Printf("process %s is in crash loop: %d crashes in a row", j.ID, crashes)
+		j.CrashLoop = true
+		j.NextRestart = nil
+		j.changed()
+		return
+	}
+	at := time.Now().Add(j.RestartPolicy.delay(j.RestartPolicy.attempt(j.Runs)))
+	if j.NextRestart != nil {
+		// keep the time scheduled before server restart
+		at = *j.NextRestart
+	}
+	j.NextRestart = &at
+	n := r.Number
+	j.restartTimer = time.AfterFunc(time.Until(at), func() { j.autoRestart(n) })
+	j.changed()
+}
+
+// autoRestart starts a new run if run n is still the latest one
+func (j *Process) autoRestart(n int) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	if j.NextRestart == nil || j.latest().Number != n {
+		return
+	}
+	j.NextRestart = nil
+	j.restartTimer = nil
+	j.Restarts++
+	r := j.addRun()
+	if err := j.start(r); err != nil {
+		log.Printf("failed to restart process %s: %s", j.ID, err)
+	}
+}
+
+// cancelRestart cancels the scheduled restart. It must be called with j.m held.
+func (j *Process) cancelRestart() bool {
+	if j.NextRestart == nil {
+		return false
+	}
+	if j.restartTimer != nil {
+		j.restartTimer.Stop()
+		j.restartTimer = nil
+	}
+	j.NextRestart = nil
+	j.changed()
+	return true
+}
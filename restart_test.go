@@ -0,0 +1,113 @@
+package gj
+
+import (
+	"testing"
+	"time"
+)
+
+// finishedRun returns a run which was running for uptime and finished in state
+func finishedRun(state State, uptime time.Duration) *Run {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &Run{
+		State: state,
+		Transitions: []Transition{
+			{State: StateCreated, At: start},
+			{State: StateRunning, At: start},
+			{State: state, At: start.Add(uptime)},
+		},
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	p := &RestartPolicy{Policy: RestartAlways, Backoff: Duration(time.Second), MaxBackoff: Duration(5 * time.Second)}
+	for _, c := range []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 5 * time.Second},
+		{100, 5 * time.Second},
+	} {
+		if d := p.delay(c.attempt); d != c.expected {
+			t.Errorf("delay mismatch: attempt=%d, got=%s, expected=%s", c.attempt, d, c.expected)
+		}
+	}
+	if d := (&RestartPolicy{}).delay(0); d != defaultBackoff {
+		t.Errorf("default delay mismatch: got=%s, expected=%s", d, defaultBackoff)
+	}
+}
+
+func TestRestartCrashed(t *testing.T) {
+	p := &RestartPolicy{Policy: RestartAlways, MinUptime: Duration(10 * time.Second)}
+	for _, c := range []struct {
+		run     *Run
+		quick   bool
+		crashed bool
+	}{
+		{finishedRun(StateFailed, time.Second), true, true},
+		{finishedRun(StateFailed, time.Minute), false, false},
+		{finishedRun(StateSucceeded, time.Second), true, false},
+		{finishedRun(StateSucceeded, time.Minute), false, false},
+		{finishedRun(StateTimedOut, 10*time.Second), false, false},
+		{&Run{State: StateLost, Transitions: []Transition{{State: StateLost}}}, true, true},
+	} {
+		if q := p.quick(c.run); q != c.quick {
+			t.Errorf("quick mismatch: state=%s, got=%v, expected=%v", c.run.State, q, c.quick)
+		}
+		if cr := p.crashed(c.run); cr != c.crashed {
+			t.Errorf("crashed mismatch: state=%s, got=%v, expected=%v", c.run.State, cr, c.crashed)
+		}
+	}
+}
+
+func TestRestartAttempt(t *testing.T) {
+	p := &RestartPolicy{Policy: RestartAlways, MinUptime: Duration(10 * time.Second)}
+	stable := finishedRun(StateSucceeded, time.Minute)
+	quick := finishedRun(StateSucceeded, time.Second)
+	failed := finishedRun(StateFailed, time.Second)
+	for _, c := range []struct {
+		runs    []*Run
+		attempt int
+		crashes int
+	}{
+		{[]*Run{stable}, 0, 0},
+		{[]*Run{quick}, 0, 0},
+		{[]*Run{failed}, 0, 1},
+		{[]*Run{stable, quick, failed}, 1, 1},
+		{[]*Run{failed, failed, stable}, 0, 0},
+		{[]*Run{quick, failed, failed}, 2, 2},
+	} {
+		if a := p.attempt(c.runs); a != c.attempt {
+			t.Errorf("attempt mismatch: runs=%d, got=%d, expected=%d", len(c.runs), a, c.attempt)
+		}
+		if n := p.crashes(c.runs); n != c.crashes {
+			t.Errorf("crashes mismatch: runs=%d, got=%d, expected=%d", len(c.runs), n, c.crashes)
+		}
+	}
+}
+
+func TestRestartRetriesReset(t *testing.T) {
+	for _, c := range []struct {
+		uptime    time.Duration
+		restarts  int
+		scheduled bool
+	}{
+		{time.Second, 3, false},
+		{time.Minute, 0, true},
+	} {
+		j := &Process{
+			ID:            "test",
+			Runs:          []*Run{finishedRun(StateFailed, c.uptime)},
+			RestartPolicy: RestartPolicy{Policy: RestartOnFailure, MaxRetries: 3},
+			Restarts:      3,
+		}
+		j.scheduleRestart()
+		if j.Restarts != c.restarts || (j.NextRestart != nil) != c.scheduled {
+			t.Errorf("restart mismatch: uptime=%s, got=%d %v, expected=%d %v",
+				c.uptime, j.Restarts, j.NextRestart != nil, c.restarts, c.scheduled)
+		}
+		j.cancelRestart()
+	}
+}
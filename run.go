@@ -0,0 +1,414 @@
+package gj
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/cgroup"
+	"github.com/yoru9zine/gj/pkg/execute"
+)
+
+// Run is an execution of the commands of a process. Its fields are
+// guarded by the mutex of the process.
+type Run struct {
+	Number      int
+	State       State
+	Transitions []Transition
+	Steps       []*StepStatus
+	Error       string
+
+	done     chan struct{}
+	running  map[int]*execute.Process
+	stopped  bool
+	killed   bool
+	signaled bool
+	timedOut bool
+	// timer times out the run from when its first command starts
+	timer *time.Timer
+	// stopCh is closed by stop to cancel waiting in the queue
+	stopCh chan struct{}
+	ticket *ticket
+	// cgroup limits resources of the run and counts its OOM kills
+	cgroup    *cgroup.Cgroup
+	oomKills  int
+	oomKilled bool
+	// dir, env and credential are resolved when the run starts
+	dir        string
+	env        []string
+	credential *syscall.Credential
+	// samples are recent resource usage read from /proc
+	samples []Sample
+	// descendants are processes of running commands found by sample,
+	// which map PIDs to start time by step
+	descendants map[int]map[int]uint64
+}
+
+func newRun(n int) *Run {
+	return &Run{
+		Number:      n,
+		State:       StateCreated,
+		Transitions: []Transition{{State: StateCreated, At: time.Now()}},
+		done:        make(chan struct{}),
+		running:     map[int]*execute.Process{},
+		stopCh:      make(chan struct{}),
+		descendants: map[int]map[int]uint64{},
+	}
+}
+
+// stop prevents r from starting more commands
+func (r *Run) stop() {
+	if !r.stopped {
+		r.stopped = true
+		close(r.stopCh)
+	}
+}
+
+func (r *Run) terminalState(err error) State {
+	switch {
+	case r.timedOut:
+		return StateTimedOut
+	case r.oomKilled:
+		return StateOOMKilled
+	case r.killed:
+		return StateKilled
+	case r.stopped:
+		return StateStopped
+	case err == nil:
+		return StateSucceeded
+	case r.signaled && r.hasSignaledStep():
+		return StateKilled
+	}
+	return StateFailed
+}
+
+func (r *Run) hasSignaledStep() bool {
+	for _, step := range r.Steps {
+		if step.Signal != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// processes returns the running commands in order of steps
+func (r *Run) processes() []*execute.Process {
+	ps := []*execute.Process{}
+	for i := range r.Steps {
+		if p, ok := r.running[i]; ok {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// primary returns the first running command, which receives stdin
+func (r *Run) primary() *execute.Process {
+	if ps := r.processes(); len(ps) > 0 {
+		return ps[0]
+	}
+	return nil
+}
+
+func (r *Run) ViewModel() *RunViewModel {
+	steps := []StepStatus{}
+	for _, s := range r.Steps {
+		steps = append(steps, *s)
+	}
+	rvm := &RunViewModel{
+		Run:         r.Number,
+		State:       r.State,
+		Transitions: append([]Transition{}, r.Transitions...),
+		Steps:       steps,
+		Error:       r.Error,
+	}
+	rvm.Usage = rvm.usage()
+	return rvm
+}
+
+type RunViewModel struct {
+	Run         int          `json:"run"`
+	State       State        `json:"state"`
+	Transitions []Transition `json:"transitions"`
+	Steps       []StepStatus `json:"steps"`
+	Error       string       `json:"error,omitempty"`
+	// Usage is the total of steps
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// ExitCode returns the exit code of the last command which exited normally,
+// or 1 when the run did not succeed and there is no such command.
+// A timed out run returns 124 like timeout(1).
+func (r *RunViewModel) ExitCode() int {
+	switch r.State {
+	case StateSucceeded:
+		return 0
+	case StateTimedOut:
+		return 124
+	}
+	for i := len(r.Steps) - 1; i >= 0; i-- {
+		if c := r.Steps[i].ExitCode; c != nil && *c > 0 {
+			return *c
+		}
+	}
+	return 1
+}
+
+func (r *RunViewModel) restore() *Run {
+	run := &Run{
+		Number:      r.Run,
+		State:       r.State,
+		Transitions: r.Transitions,
+		Error:       r.Error,
+		done:        make(chan struct{}),
+		running:     map[int]*execute.Process{},
+		stopCh:      make(chan struct{}),
+		descendants: map[int]map[int]uint64{},
+	}
+	for i := range r.Steps {
+		run.Steps = append(run.Steps, &r.Steps[i])
+	}
+	if run.State.Finished() {
+		close(run.done)
+	}
+	return run
+}
+
+func (j *Process) logOption(r *Run) *execute.ProcessOption {
+	return &execute.ProcessOption{Dir: j.LogDir, Name: filepath.Join(j.ID, strconv.Itoa(r.Number)), LogLimits: j.Log.limits(), Lines: j.Log.lineMode()}
+}
+
+func (j *Process) run(r *Run) {
+	err := j.acquire(r)
+	if err == nil {
+		err = j.runCommands(r)
+		j.release(r)
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+	defer close(r.done)
+	if err != nil {
+		log.Printf("process %s run %d exited with error: %s", j.ID, r.Number, err)
+		if r.Error == "" {
+			r.Error = err.Error()
+		}
+	}
+	if err := j.transit(r, r.terminalState(err)); err != nil {
+		log.Printf("failed to finish process %s: %s", j.ID, err)
+		return
+	}
+	j.scheduleRestart()
+}
+
+// acquire waits for a slot of the pool in the queue of the process
+func (j *Process) acquire(r *Run) error {
+	if j.pool == nil {
+		return nil
+	}
+	t := j.pool.enqueue(j.Queue, j.Priority)
+	j.m.Lock()
+	r.ticket = t
+	j.m.Unlock()
+	select {
+	case <-t.ready:
+		return nil
+	case <-r.stopCh:
+		j.release(r)
+		return ErrStopped
+	}
+}
+
+// release returns the slot acquired for r
+func (j *Process) release(r *Run) {
+	j.m.Lock()
+	t := r.ticket
+	r.ticket = nil
+	j.m.Unlock()
+	if t != nil {
+		j.pool.release(t)
+	}
+}
+
+func (j *Process) runCommands(r *Run) error {
+	logger, err := execute.NewProcessLogWriter(j.logOption(r))
+	if err != nil {
+		return err
+	}
+	cg, err := j.setupRun(r)
+	if cg != nil {
+		defer func() {
+			// processes which escaped cleanup of their commands
+			if pids, _ := cg.Procs(); len(pids) > 0 {
+				log.Printf("process %s run %d: killing %d processes left in cgroup: %v", j.ID, r.Number, len(pids), pids)
+			}
+			if err := cg.Remove(); err != nil {
+				log.Printf("process %s run %d: %s", j.ID, r.Number, err)
+			}
+		}()
+	}
+	var deps [][]int
+	if err == nil {
+		deps, err = dependencies(j.Commands)
+	}
+	if err != nil {
+		// the log tells why no command started
+		if werr := logger.Write([]byte(fmt.Sprintf(setupErrorMessage, err)), "stderr", -1); werr != nil {
+			log.Printf("process %s run %d: failed to write log: %s", j.ID, r.Number, werr)
+		}
+		logger.Close()
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go j.sample(r, stop)
+	err = j.runSteps(r, deps, logger)
+	j.m.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	j.m.Unlock()
+	if cerr := logger.Close(); cerr != nil && err == nil {
+		return fmt.Errorf("failed to close log: %s", cerr)
+	}
+	if j.indexLogs {
+		go j.indexLog(r)
+	}
+	return err
+}
+
+// setupRun resolves the identity, directory and environment of r and
+// creates its cgroup, which is nil without limits or cgroup v2
+func (j *Process) setupRun(r *Run) (*cgroup.Cgroup, error) {
+	cred, u, err := j.credential()
+	if err != nil {
+		return nil, err
+	}
+	dir, env, err := j.resolveEnv(u)
+	if err != nil {
+		return nil, err
+	}
+	cg, err := j.setupCgroup(r)
+	if err != nil {
+		return nil, err
+	}
+	if cg == nil && (j.Limits.CPU > 0 || j.Limits.Pids > 0) {
+		log.Printf("process %s run %d: cpu and pids limits need cgroup v2 and are ignored", j.ID, r.Number)
+	}
+	j.m.Lock()
+	r.dir, r.env = dir, env
+	r.credential = cred
+	r.cgroup = cg
+	j.m.Unlock()
+	return cg, nil
+}
+
+// timeout terminates step i of run r, or the whole run for -1, because
+// it exceeded its time limit
+func (j *Process) timeout(r *Run, i int, msg string) {
+	j.m.Lock()
+	if !r.State.Active() || r.stopped || (i >= 0 && r.running[i] == nil) {
+		j.m.Unlock()
+		return
+	}
+	r.timedOut = true
+	if r.Error == "" {
+		r.Error = msg
+	}
+	ps := []*execute.Process{}
+	for k, p := range r.running {
+		if i < 0 || i == k {
+			r.Steps[k].TimedOut = true
+			ps = append(ps, p)
+		}
+	}
+	if i < 0 {
+		r.stop()
+	}
+	j.m.Unlock()
+	log.Printf("process %s run %d %s", j.ID, r.Number, msg)
+	if err := j.terminateAll(r, ps, j.killGrace()); err != nil {
+		log.Printf("failed to terminate process %s: %s", j.ID, err)
+	}
+}
+
+func (j *Process) startCommand(r *Run, i int, cmd *Command, logger *execute.ProcessLogWriter) (*execute.Process, error) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	if r.stopped {
+		return nil, ErrStopped
+	}
+	if r.State == StateQueued {
+		if err := j.transit(r, StateRunning); err != nil {
+			return nil, err
+		}
+		if j.Timeout > 0 {
+			r.timer = time.AfterFunc(j.Timeout, func() {
+				j.timeout(r, -1, fmt.Sprintf("timed out after %s", j.Timeout))
+			})
+		}
+	}
+	opt := &CommandOption{
+		PTY:        j.PTY,
+		Rows:       j.Rows,
+		Cols:       j.Cols,
+		Dir:        r.dir,
+		Env:        r.env,
+		Logger:     logger,
+		Step:       i,
+		Rlimits:    j.Limits.rlimits(r.cgroup != nil),
+		Credential: r.credential,
+		Cleanup: func(pid int) {
+			j.cleanup(r, i, pid)
+		},
+	}
+	if r.cgroup != nil {
+		opt.CgroupDir = r.cgroup.Dir
+	}
+	p, err := cmd.Start(opt)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	r.Steps[i].StartedAt = &now
+	r.running[i] = p
+	j.changed()
+	return p, nil
+}
+
+// finishCommand records the result of command i. p is nil when the
+// command failed to start.
+func (j *Process) finishCommand(r *Run, i int, p *execute.Process, err error) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	delete(r.running, i)
+	now := time.Now()
+	step := r.Steps[i]
+	step.FinishedAt = &now
+	switch {
+	case err == ErrStopped:
+		step.State = StepSkipped
+	case err != nil:
+		step.State = StepFailed
+	default:
+		step.State = StepSucceeded
+	}
+	if p == nil {
+		j.changed()
+		return
+	}
+	if ps := p.ProcessState(); ps != nil {
+		code := ps.ExitCode()
+		step.ExitCode = &code
+		if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			step.Signal = ws.Signal().String()
+		}
+		if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+			step.Usage = newUsage(ru)
+		}
+	}
+	j.checkOOM(r, i)
+	j.changed()
+}
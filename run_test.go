@@ -0,0 +1,126 @@
+package gj
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runProcess runs the first run of the process defined by pvm until it
+// finishes and returns the run
+func runProcess(t *testing.T, pvm *ProcessViewModel) *RunViewModel {
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	pvm.ID = "test"
+	if err := pvm.Validate(); err != nil {
+		t.Fatalf("invalid process: %s", err)
+	}
+	j := pvm.Process()
+	j.LogDir = dir
+	if err := j.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	_, done := j.Latest()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not finish")
+	}
+	rvm, _ := j.RunViewModel(0)
+	return rvm
+}
+
+func TestProcessTimeout(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		timeout     time.Duration
+		stepTimeout time.Duration
+		commands    [][]string
+		state       State
+		timedOut    []bool
+	}{
+		{"no timeout", 0, 0, [][]string{{"true"}}, StateSucceeded, []bool{false}},
+		{"step", 0, 100 * time.Millisecond, [][]string{{"true"}, {"sleep", "5"}}, StateTimedOut, []bool{false, true}},
+		{"run", 100 * time.Millisecond, time.Minute, [][]string{{"true"}, {"sleep", "5"}}, StateTimedOut, []bool{false, true}},
+		{"run before step", 100 * time.Millisecond, 0, [][]string{{"sleep", "5"}, {"true"}}, StateTimedOut, []bool{true, false}},
+		{"tiny", time.Nanosecond, 0, [][]string{{"sleep", "5"}}, StateTimedOut, []bool{true}},
+		{"finished in time", time.Minute, time.Minute, [][]string{{"true"}}, StateSucceeded, []bool{false}},
+	} {
+		pvm := &ProcessViewModel{
+			Timeout:     Duration(c.timeout),
+			StepTimeout: Duration(c.stepTimeout),
+			KillGrace:   Duration(time.Second),
+		}
+		for _, cmd := range c.commands {
+			pvm.Commands = append(pvm.Commands, CommandSpec{Command: cmd, sequence: true})
+		}
+		r := runProcess(t, pvm)
+		if r.State != c.state {
+			t.Errorf("%s: state mismatch: got=%s, expected=%s", c.name, r.State, c.state)
+			continue
+		}
+		for i, step := range r.Steps {
+			if step.TimedOut != c.timedOut[i] {
+				t.Errorf("%s: step %d timed out: got=%v, expected=%v", c.name, i, step.TimedOut, c.timedOut[i])
+			}
+		}
+	}
+}
+
+func TestSetupErrorLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	pvm := &ProcessViewModel{
+		ID:       "test",
+		Commands: []CommandSpec{{Command: []string{"true"}}},
+		EnvFiles: []string{filepath.Join(dir, "missing.env")},
+	}
+	j := pvm.Process()
+	j.LogDir = dir
+	if err := j.Start(); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	_, done := j.Latest()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not finish")
+	}
+	if rvm, _ := j.RunViewModel(0); rvm.State != StateFailed {
+		t.Fatalf("state mismatch: got=%s, expected=%s", rvm.State, StateFailed)
+	}
+	var b bytes.Buffer
+	if err := j.WriteLog(&b, 0, nil); err != nil {
+		t.Fatalf("failed to write log: %s", err)
+	}
+	if !strings.Contains(b.String(), "missing.env") {
+		t.Errorf("log does not tell the error: %q", b.String())
+	}
+	b.Reset()
+	if err := j.FollowLog(&b, 0, nil, nil); err != nil {
+		t.Fatalf("failed to follow log: %s", err)
+	}
+	if !strings.Contains(b.String(), "missing.env") {
+		t.Errorf("followed log does not tell the error: %q", b.String())
+	}
+
+	// a run whose log was never created has empty output
+	os.RemoveAll(filepath.Join(dir, "test"))
+	b.Reset()
+	if err := j.WriteLog(&b, 0, nil); err != nil || b.Len() != 0 {
+		t.Errorf("log without file mismatch: got=%q, %v", b.String(), err)
+	}
+	if err := j.FollowLog(&b, 0, nil, nil); err != nil || b.Len() != 0 {
+		t.Errorf("followed log without file mismatch: got=%q, %v", b.String(), err)
+	}
+}
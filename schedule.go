@@ -0,0 +1,393 @@
+package gj
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/yoru9zine/gj/pkg/id"
+	"github.com/yoru9zine/gj/pkg/store"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+)
+
+const scheduleBucket = "schedules"
+
+// Overlap policies decide what a firing does while the process created
+// by the previous firing is still active
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+	OverlapAllow = "allow"
+)
+
+// cronParser accepts 5 fields, or 6 fields starting with seconds, and
+// descriptors like @hourly
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Schedule creates a process from Process at times of Cron in Timezone
+type Schedule struct {
+	ID       string
+	Name     string
+	Cron     string
+	Timezone string
+	Overlap  string
+	Paused   bool
+	// Process is the process JSON accepted by CreateProc
+	Process json.RawMessage
+
+	LastProcess string
+	LastFired   *time.Time
+	NextFire    *time.Time
+	Fired       int
+	Skipped     int
+
+	m       sync.Mutex
+	spec    cron.Schedule
+	loc     *time.Location
+	timer   *time.Timer
+	queued  bool
+	removed bool
+}
+
+// parse validates s and prepares its cron schedule
+func (s *Schedule) parse() error {
+	spec, err := cronParser.Parse(s.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression: %s", err)
+	}
+	loc := time.Local
+	if s.Timezone != "" {
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone: %s", err)
+		}
+	}
+	switch s.Overlap {
+	case "":
+		s.Overlap = OverlapSkip
+	case OverlapSkip, OverlapQueue, OverlapAllow:
+	default:
+		return fmt.Errorf("unknown overlap policy: %s", s.Overlap)
+	}
+	var pvm ProcessViewModel
+	if err := json.Unmarshal(s.Process, &pvm); err != nil {
+		return fmt.Errorf("invalid process: %s", err)
+	}
+	if err := pvm.Validate(); err != nil {
+		return fmt.Errorf("invalid process: %s", err)
+	}
+	s.spec, s.loc = spec, loc
+	return nil
+}
+
+func (s *Schedule) ViewModel() *ScheduleViewModel {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.viewModel()
+}
+
+func (s *Schedule) viewModel() *ScheduleViewModel {
+	return &ScheduleViewModel{
+		ID:          s.ID,
+		Name:        s.Name,
+		Cron:        s.Cron,
+		Timezone:    s.Timezone,
+		Overlap:     s.Overlap,
+		Paused:      s.Paused,
+		Process:     s.Process,
+		LastProcess: s.LastProcess,
+		LastFired:   s.LastFired,
+		NextFire:    s.NextFire,
+		Fired:       s.Fired,
+		Skipped:     s.Skipped,
+		Queued:      s.queued,
+	}
+}
+
+type ScheduleViewModel struct {
+	ID       string          `json:"id"`
+	Name     string          `json:"name"`
+	Cron     string          `json:"cron"`
+	Timezone string          `json:"timezone,omitempty"`
+	Overlap  string          `json:"overlap"`
+	Paused   bool            `json:"paused"`
+	Process  json.RawMessage `json:"process"`
+
+	LastProcess string     `json:"last_process,omitempty"`
+	LastFired   *time.Time `json:"last_fired_at,omitempty"`
+	NextFire    *time.Time `json:"next_fire_at,omitempty"`
+	Fired       int        `json:"fired"`
+	Skipped     int        `json:"skipped"`
+	Queued      bool       `json:"queued,omitempty"`
+}
+
+func (s *ScheduleViewModel) Schedule() *Schedule {
+	return &Schedule{
+		ID:          s.ID,
+		Name:        s.Name,
+		Cron:        s.Cron,
+		Timezone:    s.Timezone,
+		Overlap:     s.Overlap,
+		Paused:      s.Paused,
+		Process:     s.Process,
+		LastProcess: s.LastProcess,
+		LastFired:   s.LastFired,
+		Fired:       s.Fired,
+		Skipped:     s.Skipped,
+	}
+}
+
+// Scheduler fires schedules and persists them
+type Scheduler struct {
+	m         sync.RWMutex
+	schedules map[string]*Schedule
+	store     *store.Store
+	procs     *Registry
+}
+
+// NewScheduler loads schedules saved in s and starts them. Firings missed
+// while the server was stopped are not run.
+func NewScheduler(s *store.Store, procs *Registry) (*Scheduler, error) {
+	sc := &Scheduler{
+		schedules: map[string]*Schedule{},
+		store:     s,
+		procs:     procs,
+	}
+	keys, err := s.Keys(scheduleBucket)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		var svm ScheduleViewModel
+		if err := s.Get(scheduleBucket, k, &svm); err != nil {
+			log.Printf("failed to load schedule %s: %s", k, err)
+			continue
+		}
+		sched := svm.Schedule()
+		if err := sched.parse(); err != nil {
+			log.Printf("failed to load schedule %s: %s", k, err)
+			continue
+		}
+		sched.m.Lock()
+		sc.arm(sched)
+		sched.m.Unlock()
+		sc.schedules[sched.ID] = sched
+	}
+	return sc, nil
+}
+
+// Add validates, saves and starts sched
+func (sc *Scheduler) Add(sched *Schedule) error {
+	if err := sched.parse(); err != nil {
+		return err
+	}
+	// parse has checked that Process is valid
+	var pvm ProcessViewModel
+	json.Unmarshal(sched.Process, &pvm)
+	if err := sc.procs.Allowed(pvm.User, pvm.Group); err != nil {
+		return err
+	}
+	if !sc.procs.pool.HasQueue(pvm.Queue) {
+		return fmt.Errorf("queue %s not found", pvm.Queue)
+	}
+	if err := sc.procs.CheckLimits(&pvm.Limits); err != nil {
+		return err
+	}
+	sched.ID = id.New()
+	sched.m.Lock()
+	defer sched.m.Unlock()
+	sc.arm(sched)
+	if err := sc.store.Put(scheduleBucket, sched.ID, sched.viewModel()); err != nil {
+		sched.timer.Stop()
+		return err
+	}
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	sc.schedules[sched.ID] = sched
+	return nil
+}
+
+// Find returns the schedule whose ID starts with prefix
+func (sc *Scheduler) Find(prefix string) (*Schedule, error) {
+	sc.m.RLock()
+	defer sc.m.RUnlock()
+	keys := []string{}
+	for k := range sc.schedules {
+		keys = append(keys, k)
+	}
+	match, err := id.Search(keys, prefix)
+	if err != nil {
+		switch err {
+		case id.ErrDuplicated:
+			return nil, ErrNotUniq
+		case id.ErrNotFound:
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+	return sc.schedules[match], nil
+}
+
+func (sc *Scheduler) ViewModels() map[string]*ScheduleViewModel {
+	sc.m.RLock()
+	defer sc.m.RUnlock()
+	models := make(map[string]*ScheduleViewModel, len(sc.schedules))
+	for id, sched := range sc.schedules {
+		models[id] = sched.ViewModel()
+	}
+	return models
+}
+
+// Remove stops and deletes sched. Processes created by it are kept.
+func (sc *Scheduler) Remove(sched *Schedule) error {
+	sched.m.Lock()
+	sched.removed = true
+	if sched.timer != nil {
+		sched.timer.Stop()
+	}
+	sched.m.Unlock()
+	sc.m.Lock()
+	delete(sc.schedules, sched.ID)
+	sc.m.Unlock()
+	return sc.store.Delete(scheduleBucket, sched.ID)
+}
+
+// Pause stops firing sched, or resumes it when paused is false
+func (sc *Scheduler) Pause(sched *Schedule, paused bool) {
+	sched.m.Lock()
+	defer sched.m.Unlock()
+	if sched.removed || sched.Paused == paused {
+		return
+	}
+	sched.Paused = paused
+	if sched.timer != nil {
+		sched.timer.Stop()
+		sched.timer = nil
+	}
+	sc.arm(sched)
+	sc.save(sched)
+}
+
+// save persists sched. It must be called with sched.m held.
+func (sc *Scheduler) save(sched *Schedule) {
+	if sched.removed {
+		return
+	}
+	if err := sc.store.Put(scheduleBucket, sched.ID, sched.viewModel()); err != nil {
+		log.Printf("failed to save schedule %s: %s", sched.ID, err)
+	}
+}
+
+// arm sets the timer for the next firing. It must be called with sched.m held.
+func (sc *Scheduler) arm(sched *Schedule) {
+	if sched.Paused {
+		sched.NextFire = nil
+		return
+	}
+	next := sched.spec.Next(time.Now().In(sched.loc))
+	if next.IsZero() {
+		sched.NextFire = nil
+		return
+	}
+	sched.NextFire = &next
+	sched.timer = time.AfterFunc(time.Until(next), func() { sc.fire(sched) })
+}
+
+func (sc *Scheduler) fire(sched *Schedule) {
+	sched.m.Lock()
+	defer sched.m.Unlock()
+	if sched.removed || sched.Paused {
+		return
+	}
+	now := time.Now()
+	sched.LastFired = &now
+	sc.trigger(sched)
+	sc.arm(sched)
+	sc.save(sched)
+}
+
+// trigger launches a process according to the overlap policy. It must be
+// called with sched.m held.
+func (sc *Scheduler) trigger(sched *Schedule) {
+	done := sc.active(sched)
+	if done == nil || sched.Overlap == OverlapAllow {
+		sc.launch(sched)
+		return
+	}
+	if sched.Overlap == OverlapQueue && !sched.queued {
+		sched.queued = true
+		go func() {
+			<-done
+			sched.m.Lock()
+			defer sched.m.Unlock()
+			sched.queued = false
+			if sched.removed || sched.Paused {
+				return
+			}
+			sc.launch(sched)
+			sc.save(sched)
+		}()
+		return
+	}
+	log.Printf("schedule %s skipped: process %s is active", sched.ID, sched.LastProcess)
+	sched.Skipped++
+}
+
+// active returns a channel closed when the process of the last firing
+// finishes, or nil if it is not active
+func (sc *Scheduler) active(sched *Schedule) <-chan struct{} {
+	if sched.LastProcess == "" {
+		return nil
+	}
+	proc, err := sc.procs.Find(sched.LastProcess)
+	if err != nil {
+		return nil
+	}
+	state, done := proc.Latest()
+	if !state.Active() {
+		return nil
+	}
+	return done
+}
+
+// launch creates and starts a process of sched. It must be called with
+// sched.m held.
+func (sc *Scheduler) launch(sched *Schedule) {
+	var pvm ProcessViewModel
+	if err := json.Unmarshal(sched.Process, &pvm); err != nil {
+		log.Printf("failed to parse process of schedule %s: %s", sched.ID, err)
+		return
+	}
+	// queues may have changed since the schedule was created
+	if !sc.procs.pool.HasQueue(pvm.Queue) {
+		log.Printf("failed to launch process of schedule %s: queue %s not found", sched.ID, pvm.Queue)
+		return
+	}
+	// and so may cgroups after a restart of the server
+	if err := sc.procs.CheckLimits(&pvm.Limits); err != nil {
+		log.Printf("failed to launch process of schedule %s: %s", sched.ID, err)
+		return
+	}
+	pvm.ID = id.New()
+	if pvm.Name == "" {
+		pvm.Name = sched.Name
+	}
+	pvm.Schedule = sched.ID
+	proc := pvm.Process()
+	if err := sc.procs.Add(proc); err != nil {
+		log.Printf("failed to add process of schedule %s: %s", sched.ID, err)
+		return
+	}
+	if err := proc.Start(); err != nil {
+		log.Printf("failed to start process of schedule %s: %s", sched.ID, err)
+		return
+	}
+	sched.LastProcess = proc.ID
+	sched.Fired++
+}
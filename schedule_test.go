@@ -0,0 +1,112 @@
+package gj
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/store"
+)
+
+func TestScheduleOverlap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	procs, err := NewRegistry(st, filepath.Join(dir, "logs"), NewPool(0, nil), nil, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+	sc, err := NewScheduler(st, procs)
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %s", err)
+	}
+	process, _ := json.Marshal(&ProcessViewModel{Commands: []CommandSpec{{Command: []string{"sleep", "0.3"}, sequence: true}}})
+	for _, c := range []struct {
+		overlap  string
+		fired    int
+		skipped  int
+		launched int
+	}{
+		// the second and third firings happen while the first process runs
+		{OverlapSkip, 1, 2, 1},
+		{OverlapQueue, 2, 1, 2},
+		{OverlapAllow, 3, 0, 3},
+	} {
+		// the schedule fires only when triggered by the test
+		sched := &Schedule{Name: c.overlap, Cron: "0 0 1 1 *", Overlap: c.overlap, Process: process}
+		if err := sc.Add(sched); err != nil {
+			t.Fatalf("failed to add schedule: %s", err)
+		}
+		launched := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			sched.m.Lock()
+			sc.trigger(sched)
+			launched[sched.LastProcess] = true
+			sched.m.Unlock()
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			sched.m.Lock()
+			fired, skipped, queued := sched.Fired, sched.Skipped, sched.queued
+			launched[sched.LastProcess] = true
+			sched.m.Unlock()
+			if (fired == c.fired && !queued) || time.Now().After(deadline) {
+				if fired != c.fired || skipped != c.skipped || len(launched) != c.launched {
+					t.Errorf("%s: firings mismatch: got=%d %d %d, expected=%d %d %d",
+						c.overlap, fired, skipped, len(launched), c.fired, c.skipped, c.launched)
+				}
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		sc.Remove(sched)
+		for id := range launched {
+			if proc, err := procs.Find(id); err == nil && id != "" {
+				_, done := proc.Latest()
+				<-done
+			}
+		}
+	}
+}
+
+func TestScheduleLaunchLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	procs, err := NewRegistry(st, filepath.Join(dir, "logs"), NewPool(0, nil), nil, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+	sc, err := NewScheduler(st, procs)
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %s", err)
+	}
+	// the schedule may have been saved by a server with cgroups
+	process, _ := json.Marshal(&ProcessViewModel{
+		Commands: []CommandSpec{{Command: []string{"true"}, sequence: true}},
+		Limits:   Limits{Pids: 10},
+	})
+	sched := &Schedule{ID: "limits", Name: "limits", Process: process}
+	sc.launch(sched)
+	if sched.Fired != 0 || sched.LastProcess != "" {
+		t.Errorf("launched with limits refused: fired=%d, process=%s", sched.Fired, sched.LastProcess)
+	}
+	if pvms := procs.ViewModels(); len(pvms) != 0 {
+		t.Errorf("processes mismatch: got=%d, expected=0", len(pvms))
+	}
+}
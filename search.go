@@ -0,0 +1,491 @@
+package gj
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/execute"
+	"github.com/yoru9zine/gj/pkg/logindex"
+)
+
+// defaultSearchLimit is the max number of matches when SearchOption.Limit is 0
+const defaultSearchLimit = 1000
+
+// maxSearchLineLength splits longer lines, such as binary output, for search
+const maxSearchLineLength = 64 * 1024
+
+var errSearchLimit = errors.New("search limit reached")
+
+// SearchOption selects lines of logs to search
+type SearchOption struct {
+	// Pattern is a regular expression matched against each line
+	Pattern string
+	// Fixed matches Pattern as a literal string
+	Fixed      bool
+	IgnoreCase bool
+	// Stream is "stdout" or "stderr". Empty searches both.
+	Stream string
+	// Context is the number of lines shown before and after each match
+	Context int
+	// Since and Until select lines written in the range like LogOption
+	Since time.Time
+	Until time.Time
+	// Process is an ID prefix of the process to search. Empty searches all.
+	Process string
+	// Limit is the max number of matches. 0 is defaultSearchLimit.
+	Limit int
+}
+
+// Query returns o as query parameters of the search API
+func (o *SearchOption) Query() url.Values {
+	q := url.Values{}
+	q.Set("q", o.Pattern)
+	if o.Fixed {
+		q.Set("fixed", "true")
+	}
+	if o.IgnoreCase {
+		q.Set("ignore_case", "true")
+	}
+	if o.Stream != "" {
+		q.Set("stream", o.Stream)
+	}
+	if o.Context > 0 {
+		q.Set("context", strconv.Itoa(o.Context))
+	}
+	if !o.Since.IsZero() {
+		q.Set("since", o.Since.Format(time.RFC3339Nano))
+	}
+	if !o.Until.IsZero() {
+		q.Set("until", o.Until.Format(time.RFC3339Nano))
+	}
+	if o.Process != "" {
+		q.Set("proc", o.Process)
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return q
+}
+
+// ParseSearchOption parses query parameters made by Query. since and until
+// may also be ages before now.
+func ParseSearchOption(q url.Values, now time.Time) (*SearchOption, error) {
+	o := &SearchOption{Pattern: q.Get("q"), Stream: q.Get("stream"), Process: q.Get("proc")}
+	if o.Pattern == "" {
+		return nil, fmt.Errorf("q is required")
+	}
+	if o.Stream != "" && o.Stream != "stdout" && o.Stream != "stderr" {
+		return nil, fmt.Errorf("invalid stream: %s", o.Stream)
+	}
+	var err error
+	for name, v := range map[string]*bool{"fixed": &o.Fixed, "ignore_case": &o.IgnoreCase} {
+		if s := q.Get(name); s != "" {
+			if *v, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", name, s)
+			}
+		}
+	}
+	for name, v := range map[string]*int{"context": &o.Context, "limit": &o.Limit} {
+		if s := q.Get(name); s != "" {
+			if *v, err = strconv.Atoi(s); err != nil || *v < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", name, s)
+			}
+		}
+	}
+	if s := q.Get("since"); s != "" {
+		if o.Since, err = ParseLogTime(s, now); err != nil {
+			return nil, err
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if o.Until, err = ParseLogTime(s, now); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := o.regexp(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *SearchOption) expr() string {
+	p := o.Pattern
+	if o.Fixed {
+		p = regexp.QuoteMeta(p)
+	}
+	if o.IgnoreCase {
+		p = "(?i)" + p
+	}
+	return p
+}
+
+func (o *SearchOption) regexp() (*regexp.Regexp, error) {
+	re, err := regexp.Compile(o.expr())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %s", err)
+	}
+	return re, nil
+}
+
+func (o *SearchOption) streams() []string {
+	if o.Stream != "" {
+		return []string{o.Stream}
+	}
+	return []string{"stdout", "stderr"}
+}
+
+// LogMatch is a line of a log which matched a search
+type LogMatch struct {
+	Process string `json:"process"`
+	Name    string `json:"name,omitempty"`
+	Run     int    `json:"run"`
+	Stream  string `json:"stream"`
+	// Step is the index of the command which wrote the line, or -1 for old logs
+	Step int `json:"step"`
+	// Line is the line number in the stream of the step in the run, from 1
+	Line   int        `json:"line"`
+	Time   *time.Time `json:"time,omitempty"`
+	Text   string     `json:"text"`
+	Before []string   `json:"before,omitempty"`
+	After  []string   `json:"after,omitempty"`
+}
+
+// SearchResult is matches in order of processes created, runs and lines.
+// Truncated is true when there were more matches than the limit.
+type SearchResult struct {
+	Matches   []*LogMatch `json:"matches"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// searcher holds a search in progress
+type searcher struct {
+	opt *SearchOption
+	re  *regexp.Regexp
+	// literals are strings which every match contains
+	literals []string
+	limit    int
+	result   *SearchResult
+}
+
+// candidate returns false if the run of idx cannot have matches
+func (s *searcher) candidate(idx *logindex.Index) bool {
+	if !idx.Overlaps(s.opt.Since, s.opt.Until) {
+		return false
+	}
+	for _, stream := range s.opt.streams() {
+		if idx.Contains(stream, s.literals) {
+			return true
+		}
+	}
+	return false
+}
+
+// Search searches logs of all processes, or the process of opt.Process.
+// Logs of finished runs are skipped by their index if they have one.
+func (r *Registry) Search(opt *SearchOption) (*SearchResult, error) {
+	re, err := opt.regexp()
+	if err != nil {
+		return nil, err
+	}
+	s := &searcher{opt: opt, re: re, limit: opt.Limit, result: &SearchResult{Matches: []*LogMatch{}}}
+	if s.limit == 0 {
+		s.limit = defaultSearchLimit
+	}
+	if sre, err := syntax.Parse(opt.expr(), syntax.Perl); err == nil {
+		s.literals = logindex.Required(sre.Simplify())
+	}
+	var procs []*Process
+	if opt.Process != "" {
+		proc, err := r.Find(opt.Process)
+		if err != nil {
+			return nil, err
+		}
+		procs = []*Process{proc}
+	} else {
+		r.m.RLock()
+		for _, proc := range r.procs {
+			procs = append(procs, proc)
+		}
+		r.m.RUnlock()
+	}
+	created := map[*Process]time.Time{}
+	for _, proc := range procs {
+		proc.m.Lock()
+		created[proc] = proc.Runs[0].Transitions[0].At
+		proc.m.Unlock()
+	}
+	sort.Slice(procs, func(i, k int) bool {
+		if !created[procs[i]].Equal(created[procs[k]]) {
+			return created[procs[i]].Before(created[procs[k]])
+		}
+		return procs[i].ID < procs[k].ID
+	})
+	for _, proc := range procs {
+		proc.m.Lock()
+		runs := append([]*Run{}, proc.Runs...)
+		proc.m.Unlock()
+		for _, run := range runs {
+			if err := proc.searchLog(run, s); err == errSearchLimit {
+				return s.result, nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s.result, nil
+}
+
+func (j *Process) indexFile(r *Run) string {
+	return filepath.Join(j.LogDir, j.ID, strconv.Itoa(r.Number), "index.json")
+}
+
+// indexLog saves the index of the log of run r, which must be finished
+func (j *Process) indexLog(r *Run) {
+	b := logindex.NewBuilder()
+	if err := execute.ReadProcessLog(j.logOption(r), func(rec *execute.LogRecord) error {
+		b.Add(rec.Type, rec.Step, rec.Data, rec.Time)
+		return nil
+	}); err != nil {
+		log.Printf("process %s run %d: failed to index log: %s", j.ID, r.Number, err)
+		return
+	}
+	if err := b.Index().Save(j.indexFile(r)); err != nil {
+		log.Printf("process %s run %d: %s", j.ID, r.Number, err)
+	}
+}
+
+// searchLog adds matches in the log of run r to s. The index of a finished
+// run is used to skip it, or saved after the log is read if it is missing.
+func (j *Process) searchLog(r *Run, s *searcher) error {
+	j.m.Lock()
+	state := r.State
+	j.m.Unlock()
+	opt := j.logOption(r)
+	if !execute.LogExists(opt) {
+		return nil
+	}
+	var b *logindex.Builder
+	if j.indexLogs && state.Finished() {
+		idx, err := logindex.Load(j.indexFile(r))
+		if err == nil && !s.candidate(idx) {
+			return nil
+		}
+		if err != nil {
+			b = logindex.NewBuilder()
+		}
+	}
+	rs := &runSearch{s: s, proc: j, run: r.Number, lines: map[streamKey]*lineState{}}
+	err := execute.ReadProcessLog(opt, func(rec *execute.LogRecord) error {
+		if b != nil {
+			b.Add(rec.Type, rec.Step, rec.Data, rec.Time)
+		}
+		return rs.record(rec)
+	})
+	if err == nil {
+		err = rs.end()
+	}
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		if err := b.Index().Save(j.indexFile(r)); err != nil {
+			log.Printf("process %s run %d: %s", j.ID, r.Number, err)
+		}
+	}
+	return nil
+}
+
+// runSearch splits records of a run into lines of each stream of each
+// command and matches them
+type runSearch struct {
+	s     *searcher
+	proc  *Process
+	run   int
+	lines map[streamKey]*lineState
+}
+
+// streamKey identifies lines of a stream of a command, since commands
+// running in parallel share a log
+type streamKey struct {
+	stream string
+	step   int
+}
+
+// lineState is the line being read of a stream of a command
+type lineState struct {
+	buf []byte
+	// open is true when buf holds a line, which may be empty yet
+	open bool
+	time time.Time
+	n    int
+	// before are the last lines for context
+	before []string
+	// after are matches waiting for lines after them
+	after []*LogMatch
+}
+
+func (rs *runSearch) record(rec *execute.LogRecord) error {
+	if !rs.s.searched(rec.Type) {
+		return nil
+	}
+	key := streamKey{rec.Type, rec.Step}
+	ls := rs.lines[key]
+	if ls == nil {
+		ls = &lineState{}
+		rs.lines[key] = ls
+	}
+	if rec.Truncated {
+		// the line is cut by the size limit
+		if ls.open {
+			return rs.line(key, ls)
+		}
+		return rs.more()
+	}
+	data := rec.Data
+	for len(data) > 0 {
+		if !ls.open {
+			ls.open = true
+			ls.time = rec.Time
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			ls.buf = append(ls.buf, data...)
+			if len(ls.buf) >= maxSearchLineLength {
+				return rs.line(key, ls)
+			}
+			return rs.more()
+		}
+		ls.buf = append(ls.buf, data[:i]...)
+		data = data[i+1:]
+		if err := rs.line(key, ls); err != nil {
+			return err
+		}
+	}
+	return rs.more()
+}
+
+// end matches the last lines which have no newline in order of streams
+// and steps
+func (rs *runSearch) end() error {
+	keys := []streamKey{}
+	for key, ls := range rs.lines {
+		if ls.open {
+			keys = append(keys, key)
+		}
+	}
+	order := map[string]int{}
+	for i, t := range rs.s.opt.streams() {
+		order[t] = i
+	}
+	sort.Slice(keys, func(i, k int) bool {
+		if keys[i].stream != keys[k].stream {
+			return order[keys[i].stream] < order[keys[k].stream]
+		}
+		return keys[i].step < keys[k].step
+	})
+	for _, key := range keys {
+		if err := rs.line(key, rs.lines[key]); err != nil {
+			return err
+		}
+	}
+	if rs.s.result.Truncated {
+		// the run has no more lines for context
+		return errSearchLimit
+	}
+	return nil
+}
+
+// more returns errSearchLimit when the search has more matches than the
+// limit and no match waits for lines after it
+func (rs *runSearch) more() error {
+	if !rs.s.result.Truncated {
+		return nil
+	}
+	for _, ls := range rs.lines {
+		if len(ls.after) > 0 {
+			return nil
+		}
+	}
+	return errSearchLimit
+}
+
+func (rs *runSearch) line(key streamKey, ls *lineState) error {
+	s := rs.s
+	text := strings.TrimSuffix(string(ls.buf), "\r")
+	t := ls.time
+	ls.buf = ls.buf[:0]
+	ls.open = false
+	ls.n++
+	waiting := ls.after[:0]
+	for _, m := range ls.after {
+		m.After = append(m.After, text)
+		if len(m.After) < s.opt.Context {
+			waiting = append(waiting, m)
+		}
+	}
+	ls.after = waiting
+	if s.selected(t) && s.re.MatchString(text) {
+		if len(s.result.Matches) == s.limit {
+			// lines after the last matches are still read for context
+			s.result.Truncated = true
+			return rs.more()
+		}
+		m := &LogMatch{
+			Process: rs.proc.ID,
+			Name:    rs.proc.Name,
+			Run:     rs.run,
+			Stream:  key.stream,
+			Step:    key.step,
+			Line:    ls.n,
+			Text:    text,
+		}
+		if !t.IsZero() {
+			m.Time = &t
+		}
+		if len(ls.before) > 0 {
+			m.Before = append([]string{}, ls.before...)
+		}
+		s.result.Matches = append(s.result.Matches, m)
+		if s.opt.Context > 0 {
+			ls.after = append(ls.after, m)
+		}
+	}
+	if s.opt.Context > 0 {
+		if len(ls.before) == s.opt.Context {
+			ls.before = ls.before[1:]
+		}
+		ls.before = append(ls.before, text)
+	}
+	return nil
+}
+
+// searched returns true if lines of stream are searched
+func (s *searcher) searched(stream string) bool {
+	for _, t := range s.opt.streams() {
+		if t == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// selected returns true if a line written at t is in the time range
+func (s *searcher) selected(t time.Time) bool {
+	if s.opt.Since.IsZero() && s.opt.Until.IsZero() {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	return !t.Before(s.opt.Since) && (s.opt.Until.IsZero() || !t.After(s.opt.Until))
+}
@@ -0,0 +1,126 @@
+package gj
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yoru9zine/gj/pkg/execute"
+)
+
+func TestSearchContext(t *testing.T) {
+	// records split lines anywhere, and the last line has no newline
+	records := []string{"l1\nm", "2\nl3\nl4\n", "m5\nm6\nl7"}
+	type match struct {
+		line   int
+		before []string
+		after  []string
+	}
+	for _, c := range []struct {
+		context  int
+		expected []match
+	}{
+		{0, []match{{2, nil, nil}, {5, nil, nil}, {6, nil, nil}}},
+		{1, []match{
+			{2, []string{"l1"}, []string{"l3"}},
+			{5, []string{"l4"}, []string{"m6"}},
+			{6, []string{"m5"}, []string{"l7"}},
+		}},
+		{2, []match{
+			{2, []string{"l1"}, []string{"l3", "l4"}},
+			{5, []string{"l3", "l4"}, []string{"m6", "l7"}},
+			{6, []string{"l4", "m5"}, []string{"l7"}},
+		}},
+	} {
+		opt := &SearchOption{Pattern: "^m", Context: c.context, Stream: "stdout"}
+		re, err := opt.regexp()
+		if err != nil {
+			t.Fatalf("failed to compile: %s", err)
+		}
+		s := &searcher{opt: opt, re: re, limit: defaultSearchLimit, result: &SearchResult{}}
+		rs := &runSearch{s: s, proc: &Process{ID: "test"}, run: 1, lines: map[streamKey]*lineState{}}
+		for _, data := range records {
+			if err := rs.record(&execute.LogRecord{Type: "stdout", Data: []byte(data)}); err != nil {
+				t.Fatalf("failed to search: %s", err)
+			}
+		}
+		if err := rs.end(); err != nil {
+			t.Fatalf("failed to search: %s", err)
+		}
+		got := []match{}
+		for _, m := range s.result.Matches {
+			got = append(got, match{m.Line, m.Before, m.After})
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("context %d: matches mismatch:\ngot=%+v\nexpected=%+v", c.context, got, c.expected)
+		}
+	}
+}
+
+// searchRecords searches records of a run of stdout and stderr
+func searchRecords(t *testing.T, opt *SearchOption, limit int, records []*execute.LogRecord) *SearchResult {
+	re, err := opt.regexp()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	s := &searcher{opt: opt, re: re, limit: limit, result: &SearchResult{}}
+	rs := &runSearch{s: s, proc: &Process{ID: "test"}, run: 1, lines: map[streamKey]*lineState{}}
+	for _, rec := range records {
+		if err := rs.record(rec); err == errSearchLimit {
+			return s.result
+		} else if err != nil {
+			t.Fatalf("failed to search: %s", err)
+		}
+	}
+	if err := rs.end(); err != nil && err != errSearchLimit {
+		t.Fatalf("failed to search: %s", err)
+	}
+	return s.result
+}
+
+func TestSearchParallelSteps(t *testing.T) {
+	// partial lines of two steps interleave in the log, and "ret" and "ry" are
+	// not one line
+	records := []*execute.LogRecord{
+		{Type: "stderr", Step: 0, Data: []byte("conn")},
+		{Type: "stderr", Step: 1, Data: []byte("tim")},
+		{Type: "stderr", Step: 0, Data: []byte("ection refused\n")},
+		{Type: "stderr", Step: 1, Data: []byte("eout\nret")},
+		{Type: "stderr", Step: 0, Data: []byte("ry")},
+	}
+	result := searchRecords(t, &SearchOption{Pattern: "connection refused|timeout|retry|ry"}, defaultSearchLimit, records)
+	type match struct {
+		step int
+		line int
+		text string
+	}
+	got := []match{}
+	for _, m := range result.Matches {
+		got = append(got, match{m.Step, m.Line, m.Text})
+	}
+	expected := []match{{0, 1, "connection refused"}, {1, 1, "timeout"}, {0, 2, "ry"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("matches mismatch:\ngot=%+v\nexpected=%+v", got, expected)
+	}
+}
+
+func TestSearchLimitContext(t *testing.T) {
+	records := []*execute.LogRecord{{Type: "stdout", Data: []byte("m1\nm2\nl3\nm4\nl5\n")}}
+	for _, c := range []struct {
+		limit     int
+		after     [][]string
+		truncated bool
+	}{
+		{1, [][]string{{"m2", "l3"}}, true},
+		{2, [][]string{{"m2", "l3"}, {"l3", "m4"}}, true},
+		{3, [][]string{{"m2", "l3"}, {"l3", "m4"}, {"l5"}}, false},
+	} {
+		result := searchRecords(t, &SearchOption{Pattern: "^m", Context: 2}, c.limit, records)
+		after := [][]string{}
+		for _, m := range result.Matches {
+			after = append(after, m.After)
+		}
+		if !reflect.DeepEqual(after, c.after) || result.Truncated != c.truncated {
+			t.Errorf("limit %d: mismatch: got=%v truncated=%v, expected=%v truncated=%v", c.limit, after, result.Truncated, c.after, c.truncated)
+		}
+	}
+}
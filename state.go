@@ -0,0 +1,99 @@
+package gj
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidTransition = errors.New("invalid state transition")
+)
+
+// State represents lifecycle state of a process
+type State string
+
+const (
+	StateCreated   State = "created"
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateStopped   State = "stopped"
+	StateKilled    State = "killed"
+	StateTimedOut  State = "timed_out"
+	// StateOOMKilled is set when the OOM killer killed a command in the cgroup of the run
+	StateOOMKilled State = "oom_killed"
+	// StateLost is set on restart for processes active when the server stopped
+	StateLost State = "lost"
+)
+
+var transitions = map[State][]State{
+	StateCreated: {StateQueued},
+	StateQueued:  {StateRunning, StateFailed, StateStopped, StateLost},
+	StateRunning: {StateSucceeded, StateFailed, StateStopped, StateKilled, StateTimedOut, StateOOMKilled, StateLost},
+}
+
+// Finished returns true if s is a terminal state
+func (s State) Finished() bool {
+	_, ok := transitions[s]
+	return !ok
+}
+
+// Active returns true while the process is waiting for or running commands
+func (s State) Active() bool {
+	return s == StateQueued || s == StateRunning
+}
+
+func (s State) canTransit(to State) bool {
+	for _, t := range transitions[s] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition is a record of state change
+type Transition struct {
+	State State     `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// StepState represents state of a command in a run
+type StepState string
+
+const (
+	StepPending   StepState = "pending"
+	StepRunning   StepState = "running"
+	StepSucceeded StepState = "succeeded"
+	StepFailed    StepState = "failed"
+	// StepSkipped is set when a needed step failed or the run was stopped
+	StepSkipped StepState = "skipped"
+)
+
+// StepStatus is the result of a command in a run
+type StepStatus struct {
+	Name       string     `json:"name,omitempty"`
+	State      StepState  `json:"state,omitempty"`
+	ExitCode   *int       `json:"exit_code"`
+	Signal     string     `json:"signal,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	TimedOut   bool       `json:"timed_out,omitempty"`
+	OOMKilled  bool       `json:"oom_killed,omitempty"`
+	Usage      *Usage     `json:"usage,omitempty"`
+	// Leftovers are processes terminated after the command exited
+	Leftovers []LeftoverProcess `json:"leftovers,omitempty"`
+}
+
+// transit changes the state of r and saves j. It must be called with j.m held.
+func (j *Process) transit(r *Run, to State) error {
+	if !r.State.canTransit(to) {
+		return fmt.Errorf("%s: %s -> %s", ErrInvalidTransition, r.State, to)
+	}
+	r.State = to
+	r.Transitions = append(r.Transitions, Transition{State: to, At: time.Now()})
+	j.changed()
+	return nil
+}
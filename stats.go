@@ -0,0 +1,181 @@
+package gj
+
+import (
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/yoru9zine/gj/pkg/procstat"
+)
+
+const (
+	// sampleInterval is the interval of reading /proc while a run is running
+	sampleInterval = time.Second
+	// maxSamples is the number of recent samples kept for a run
+	maxSamples = 60
+)
+
+// Usage is resource usage of exited commands reported by wait4(2).
+// It includes descendants which the commands waited for.
+type Usage struct {
+	UserCPU   Duration `json:"user_cpu"`
+	SystemCPU Duration `json:"system_cpu"`
+	MaxRSS    ByteSize `json:"max_rss"`
+	// InBlocks and OutBlocks count block I/O operations
+	InBlocks  int64 `json:"in_blocks"`
+	OutBlocks int64 `json:"out_blocks"`
+}
+
+func newUsage(ru *syscall.Rusage) *Usage {
+	return &Usage{
+		UserCPU:   Duration(time.Duration(ru.Utime.Nano())),
+		SystemCPU: Duration(time.Duration(ru.Stime.Nano())),
+		// ru_maxrss is in kilobytes on Linux
+		MaxRSS:    ByteSize(ru.Maxrss * 1024),
+		InBlocks:  ru.Inblock,
+		OutBlocks: ru.Oublock,
+	}
+}
+
+// add accumulates o into u. MaxRSS is the maximum of steps because
+// steps may run in parallel or one after another.
+func (u *Usage) add(o *Usage) {
+	u.UserCPU += o.UserCPU
+	u.SystemCPU += o.SystemCPU
+	if o.MaxRSS > u.MaxRSS {
+		u.MaxRSS = o.MaxRSS
+	}
+	u.InBlocks += o.InBlocks
+	u.OutBlocks += o.OutBlocks
+}
+
+// usage returns the total usage of finished steps, or nil if there is none
+func (r *RunViewModel) usage() *Usage {
+	var total *Usage
+	for _, s := range r.Steps {
+		if s.Usage == nil {
+			continue
+		}
+		if total == nil {
+			total = &Usage{}
+		}
+		total.add(s.Usage)
+	}
+	return total
+}
+
+// Sample is resource usage of running commands and their descendants read from /proc
+type Sample struct {
+	At         time.Time `json:"at"`
+	CPUPercent float64   `json:"cpu_percent"`
+	RSS        ByteSize  `json:"rss"`
+	Processes  int       `json:"processes"`
+	ReadBytes  ByteSize  `json:"read_bytes"`
+	WriteBytes ByteSize  `json:"write_bytes"`
+}
+
+// StatsViewModel is resource usage of a run
+type StatsViewModel struct {
+	Run   int    `json:"run"`
+	State State  `json:"state"`
+	Usage *Usage `json:"usage,omitempty"`
+	// Current is the latest sample while the run is running
+	Current *Sample  `json:"current,omitempty"`
+	Samples []Sample `json:"samples"`
+}
+
+// Stats returns resource usage of the run numbered n, or the latest run for 0
+func (j *Process) Stats(n int) (*StatsViewModel, error) {
+	r, err := j.findRun(n)
+	if err != nil {
+		return nil, err
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+	rvm := r.ViewModel()
+	s := &StatsViewModel{
+		Run:     r.Number,
+		State:   r.State,
+		Usage:   rvm.Usage,
+		Samples: append([]Sample{}, r.samples...),
+	}
+	if r.State == StateRunning && len(r.samples) > 0 {
+		last := r.samples[len(r.samples)-1]
+		s.Current = &last
+	}
+	return s, nil
+}
+
+// sample reads /proc periodically for the running commands of r until stop
+// is closed. It also records descendants of the commands for cleanup.
+func (j *Process) sample(r *Run, stop <-chan struct{}) {
+	t := time.NewTicker(sampleInterval)
+	defer t.Stop()
+	var (
+		lastCPU time.Duration
+		lastAt  time.Time
+	)
+	for {
+		var now time.Time
+		select {
+		case <-stop:
+			return
+		case now = <-t.C:
+		}
+		j.m.Lock()
+		pids := map[int]int{}
+		seen := map[int]map[int]uint64{}
+		for i, p := range r.running {
+			pids[i] = p.Pid()
+			seen[i] = map[int]uint64{}
+			for pid, start := range r.descendants[i] {
+				seen[i][pid] = start
+			}
+		}
+		j.m.Unlock()
+		if len(pids) == 0 {
+			continue
+		}
+		stats, err := procstat.List()
+		if err != nil {
+			log.Printf("process %s run %d: failed to read /proc: %s", j.ID, r.Number, err)
+			return
+		}
+		s := Sample{At: now}
+		var cpu time.Duration
+		counted := map[int]bool{}
+		for i, pid := range pids {
+			for _, st := range commandTree(stats, pid, seen[i]) {
+				if st.PID != pid {
+					seen[i][st.PID] = st.Start
+				}
+				if counted[st.PID] {
+					continue
+				}
+				counted[st.PID] = true
+				s.Processes++
+				s.RSS += ByteSize(st.RSS)
+				s.ReadBytes += ByteSize(st.ReadBytes)
+				s.WriteBytes += ByteSize(st.WriteBytes)
+				cpu += st.UTime + st.STime
+			}
+		}
+		// cpu decreases when processes exit between samples
+		if !lastAt.IsZero() && cpu > lastCPU {
+			s.CPUPercent = float64(cpu-lastCPU) / float64(now.Sub(lastAt)) * 100
+		}
+		lastCPU, lastAt = cpu, now
+		j.m.Lock()
+		for i := range pids {
+			// cleanup takes descendants of exited commands
+			if r.running[i] != nil {
+				r.descendants[i] = seen[i]
+			}
+		}
+		r.samples = append(r.samples, s)
+		if len(r.samples) > maxSamples {
+			r.samples = r.samples[len(r.samples)-maxSamples:]
+		}
+		j.m.Unlock()
+	}
+}
@@ -0,0 +1,82 @@
+package gj
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is time.Duration written as a string like "1m30s" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m30s\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ByteSize is a number of bytes written as a number or a string with a
+// binary unit like "512M" or "1GiB" in JSON
+type ByteSize int64
+
+func (s ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(s))
+}
+
+func (s *ByteSize) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*s = ByteSize(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("size must be a number or a string like \"512M\": %s", b)
+	}
+	v, err := ParseByteSize(str)
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// ParseByteSize parses a size like "1024", "64K", "512M", "1GiB" or "2TB".
+// Units are powers of 1024.
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	unit := int64(1)
+	if str != "" {
+		switch str[len(str)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			str = str[:len(str)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
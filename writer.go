@@ -0,0 +1,100 @@
+package gj
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/yoru9zine/gj/pkg/store"
+)
+
+// storeWriter saves values to the store in the background, so that
+// processes do not wait for syncs of the disk while holding their locks.
+// Values are written in order of their last change, and only the latest
+// value of each key is written.
+type storeWriter struct {
+	store *store.Store
+	m     sync.Mutex
+	// pending maps keys to encoded values, or nil to delete them
+	pending map[storeKey]json.RawMessage
+	order   []storeKey
+	running bool
+	idle    *sync.Cond
+}
+
+type storeKey struct {
+	bucket string
+	key    string
+}
+
+func newStoreWriter(s *store.Store) *storeWriter {
+	w := &storeWriter{store: s, pending: map[storeKey]json.RawMessage{}}
+	w.idle = sync.NewCond(&w.m)
+	return w
+}
+
+// put encodes v now and writes it later
+func (w *storeWriter) put(bucket, key string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to encode %s/%s: %s", bucket, key, err)
+		return
+	}
+	w.enqueue(storeKey{bucket, key}, b)
+}
+
+// remove deletes key later
+func (w *storeWriter) remove(bucket, key string) {
+	w.enqueue(storeKey{bucket, key}, nil)
+}
+
+func (w *storeWriter) enqueue(k storeKey, b json.RawMessage) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, ok := w.pending[k]; ok {
+		for i := range w.order {
+			if w.order[i] == k {
+				w.order = append(w.order[:i], w.order[i+1:]...)
+				break
+			}
+		}
+	}
+	w.pending[k] = b
+	w.order = append(w.order, k)
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+// run writes pending values until none is left
+func (w *storeWriter) run() {
+	w.m.Lock()
+	for len(w.order) > 0 {
+		k := w.order[0]
+		w.order = w.order[1:]
+		b := w.pending[k]
+		delete(w.pending, k)
+		w.m.Unlock()
+		if b == nil {
+			if err := w.store.Delete(k.bucket, k.key); err != nil {
+				log.Printf("failed to remove %s/%s: %s", k.bucket, k.key, err)
+			}
+		} else if err := w.store.Put(k.bucket, k.key, b); err != nil {
+			log.Printf("failed to save %s/%s: %s", k.bucket, k.key, err)
+		}
+		w.m.Lock()
+	}
+	w.running = false
+	w.idle.Broadcast()
+	w.m.Unlock()
+}
+
+// flush waits until pending values are written
+func (w *storeWriter) flush() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	for w.running {
+		w.idle.Wait()
+	}
+}
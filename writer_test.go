@@ -0,0 +1,37 @@
+package gj
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/yoru9zine/gj/pkg/store"
+)
+
+func TestStoreWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gj")
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	w := newStoreWriter(st)
+	for i := 1; i <= 100; i++ {
+		w.put("values", "a", &RunViewModel{Run: i})
+		w.put("values", "b", &RunViewModel{Run: i})
+	}
+	w.remove("values", "b")
+	w.put("values", "c", &RunViewModel{Run: 1})
+	w.flush()
+	if keys, _ := st.Keys("values"); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("keys mismatch: got=%v, expected=%v", keys, []string{"a", "c"})
+	}
+	var rvm RunViewModel
+	if err := st.Get("values", "a", &rvm); err != nil || rvm.Run != 100 {
+		t.Errorf("value mismatch: got=%d %v, expected=100", rvm.Run, err)
+	}
+}